@@ -34,16 +34,16 @@
 package aesgcm
 
 import (
-	"crypto/aes"
+	"context"
 	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sync"
+	"sync/atomic"
 
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
@@ -56,70 +56,235 @@ var (
 	errReadOnly         = errors.New("leveldb/storage: storage is read only")
 	errCorruptedCurrent = errors.New("leveldb/storage: corrupted or incomplete CURRENT file")
 	errNonceUnavailable = errors.New("leveldb/aesgcm: unable to generate a nonce")
+
+	errCoreDumpsUnsupported = errors.New("leveldb/aesgcm: core dump control is only supported on linux")
 )
 
+// Storage is the storage.Storage returned by OpenEncryptedFile, extended with accessors specific to the
+// encrypted storage.
+type Storage interface {
+	storage.Storage
+
+	// Metrics returns the collector recording the cost of the encryption layer
+	Metrics() *Metrics
+
+	// MemoryUsage returns the number of decrypted plaintext bytes currently held by open readers
+	MemoryUsage() int64
+
+	// Quarantined returns the reports of the files in the quarantine directory, oldest first
+	Quarantined() ([]QuarantineReport, error)
+
+	// Salvage reads whatever still authenticates of a damaged file, chunk by chunk
+	Salvage(fd storage.FileDesc) (*SalvageResult, error)
+
+	// Verify decrypts and authenticates a whole file without keeping its plaintext
+	Verify(fd storage.FileDesc) (int64, error)
+
+	// OpenHandles returns the readers and writers currently open, oldest first
+	OpenHandles() []Handle
+
+	// CheckKey checks the key against the storage's files, failing with an *AuthError wrapping ErrWrongKey
+	// if none authenticates and some were sealed under another key. A storage without files passes.
+	CheckKey() error
+
+	// Checkpoint makes a copy of the storage in the new directory dir that opens as a database of its own
+	Checkpoint(dir string) error
+}
+
 type aesgcmStorage struct {
 	path     string
 	readOnly bool
 
 	mu    sync.Mutex
 	flock fileLock
+	// Files are opened relative to it
+	dir   *dirHandle
 	slock *aesgcmStorageLock
 	buf   []byte
 	// Opened file counter; if open < 0 means closed.
 	open int
 
-	cyp cipher.AEAD
+	cyp     cipher.AEAD
+	metrics *Metrics
+	hooks   *Hooks
+	budget  *memoryBudget
+	handles *handleRegistry
+	// Writers not closed yet, committed by SetMeta and Checkpoint
+	writers map[*aesgcmWriter]struct{}
+	// Held by Checkpoint, so no file is removed while it links them
+	pauseRemove sync.RWMutex
+	// Number of goroutines sealing or opening the chunks of a single file
+	concurrency int
+	// Plaintext a writer holds before sealing and writing out full chunks
+	writeBuffer int
+	durability  Durability
+	quarantine  bool
+	// Set once a file authenticated, so the key is known to be right
+	keyOK int32
+	// Writers read back and authenticate what they wrote before a Sync returns
+	verifyWrites bool
+	// Plaintext size of the chunks of new files
+	chunkSize int
+	// Permissions of created files and directories
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	logger   Logger
+	// Larger files are refused rather than read into memory
+	maxFileSize int64
+	// Batches journal fsyncs under DurabilityRelaxed, nil otherwise
+	syncer *intervalSyncer
+
+	// Set when core dumps were disabled
+	coreDumps bool
 }
 
-func OpenEncryptedFile(path string, key []byte, readOnly bool) (storage.Storage, error) {
+// OpenEncryptedFile opens the encrypted storage in the directory at path, creating it unless readOnly is set.
+// The key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256. It is expanded into the AES
+// key schedule held by crypto/aes on the Go heap, which can't be locked into memory or wiped, and the caller's
+// key is left for the caller to wipe.
+func OpenEncryptedFile(path string, key []byte, readOnly bool) (Storage, error) {
+	return OpenEncryptedFileWithOptions(path, key, &Options{ReadOnly: readOnly})
+}
 
-	ace, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+// OpenEncryptedFileWithOptions is OpenEncryptedFile with the optional parameters in o. A nil o gives the
+// defaults of a writable storage. It fails at once with a *LockError if another process holds the
+// directory's lock.
+func OpenEncryptedFileWithOptions(path string, key []byte, o *Options) (stor Storage, err error) {
+	return openEncryptedFile(nil, path, key, o)
+}
+
+// OpenEncryptedFileContext is OpenEncryptedFileWithOptions, except that while another process holds the
+// directory's lock it waits for it, until ctx is done.
+func OpenEncryptedFileContext(ctx context.Context, path string, key []byte, o *Options) (stor Storage, err error) {
+	if ctx == nil {
+		panic("leveldb/aesgcm: nil context")
+	}
+	return openEncryptedFile(ctx, path, key, o)
+}
+
+// openEncryptedFile opens the storage, waiting for the lock until ctx is done, or not at all if it is nil
+func openEncryptedFile(ctx context.Context, path string, key []byte, o *Options) (stor Storage, err error) {
+	secondary := o.GetSecondary()
+	readOnly := o.GetReadOnly() || secondary
+
+	if src := o.GetKeySource(); src != nil {
+		if key != nil {
+			return nil, errKeyAndSource
+		}
+		if key, err = src.Key(); err != nil {
+			return nil, err
+		}
+		// Copied into the cipher by the time this returns
+		defer wipe(key)
 	}
 
-	cyp, err := cipher.NewGCM(ace)
+	cyp, err := newCipher(o.GetCipherSuite(), key)
 	if err != nil {
 		return nil, err
 	}
 
-	if fi, err := os.Stat(path); err == nil {
+	fi, err := os.Stat(path)
+	if err == nil {
 		if !fi.IsDir() {
 			return nil, fmt.Errorf("leveldb/storage: open %s: not a directory", path)
 		}
 	} else if os.IsNotExist(err) && !readOnly {
-		if err := os.MkdirAll(path, 0755); err != nil {
+		if err := os.MkdirAll(path, o.GetDirMode()); err != nil {
+			return nil, err
+		}
+		if fi, err = os.Stat(path); err != nil {
 			return nil, err
 		}
 	} else {
 		return nil, err
 	}
-
-	flock, err := newFileLock(filepath.Join(path, "LOCK"), readOnly)
-	if err != nil {
+	if err := checkDirMode(path, fi, o.GetPermissionCheck(), o.GetLogger()); err != nil {
 		return nil, err
 	}
 
+	var flock fileLock = nopFileLock{}
+	if !secondary {
+		if flock, err = acquireFileLock(ctx, filepath.Join(path, "LOCK"), o.GetFileMode(), readOnly); err != nil {
+			return nil, err
+		}
+	}
+
 	defer func() {
 		if err != nil {
 			flock.release()
 		}
 	}()
 
+	dir, err := openDirHandle(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			dir.close()
+		}
+	}()
+
+	if !readOnly {
+		if err = removePending(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.GetDisableCoreDumps() {
+		if err = disableCoreDumps(); err != nil {
+			return nil, err
+		}
+	}
+
+	metrics := o.GetMetrics()
+	if metrics == nil {
+		metrics = NewMetrics()
+	}
 	fs := &aesgcmStorage{
 		path:     path,
 		readOnly: readOnly,
 		flock:    flock,
+		dir:      dir,
 		cyp:      cyp,
+		metrics:  metrics,
+		hooks:    o.GetHooks(),
+		budget:   newMemoryBudget(o.GetMemoryBudget(), metrics),
+		handles:  newHandleRegistry(o.GetDebug()),
+		writers:  make(map[*aesgcmWriter]struct{}),
+
+		concurrency: o.GetConcurrency(),
+		writeBuffer: o.GetWriteBufferSize(),
+		durability:  o.GetDurability(),
+		quarantine:  o.GetQuarantine() && !readOnly,
+
+		verifyWrites: o.GetVerifyWrites(),
+		chunkSize:    o.GetChunkSize(),
+		fileMode:     o.GetFileMode(),
+		dirMode:      o.GetDirMode(),
+		logger:       o.GetLogger(),
+		maxFileSize:  o.GetMaxFileSize(),
+		coreDumps:    o.GetDisableCoreDumps(),
+	}
+	if fs.durability == DurabilityRelaxed && !readOnly {
+		fs.syncer = newIntervalSyncer(fs, o.GetSyncInterval())
 	}
 	runtime.SetFinalizer(fs, (*aesgcmStorage).Close)
 	return fs, nil
 }
 
+func (fs *aesgcmStorage) Metrics() *Metrics {
+	return fs.metrics
+}
+
+func (fs *aesgcmStorage) MemoryUsage() int64 {
+	return fs.budget.usage()
+}
+
 func (fs *aesgcmStorage) Log(str string) {
-	//println(str)
-	// TODO: Pluggable logging
+	if fs.logger != nil {
+		fs.logger.Log(str)
+	}
 }
 
 func fdGenAD(fd storage.FileDesc) []byte {
@@ -129,39 +294,96 @@ func fdGenAD(fd storage.FileDesc) []byte {
 	return ret
 }
 
-func (fs *aesgcmStorage) Open(fd storage.FileDesc) (storage.Reader, error) {
-	fs.Log(fmt.Sprintf("opening %s", fd))
-	if !storage.FileDescOk(fd) {
-		return nil, storage.ErrInvalidFile
+// acquire counts a new open file, failing once the storage is closed
+func (fs *aesgcmStorage) acquire() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.open < 0 {
+		return storage.ErrClosed
 	}
+	fs.open++
+	return nil
+}
 
+// release uncounts an open file. Files may outlive the storage, so a closed storage is left closed.
+func (fs *aesgcmStorage) release() {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
-	if fs.open < 0 {
-		return nil, storage.ErrClosed
+	if fs.open > 0 {
+		fs.open--
 	}
-	of, err := os.OpenFile(filepath.Join(fs.path, fsGenName(fd)), os.O_RDONLY, 0)
+}
+
+// decryptFile reads and authenticates the whole of an open file
+func (fs *aesgcmStorage) decryptFile(fd storage.FileDesc, of *os.File) ([]byte, error) {
+	crypt, err := fs.readCiphertext(fd, of)
 	if err != nil {
 		return nil, err
 	}
-	defer of.Close()
+	defer putBuffer(crypt)
+
+	var plain []byte
+	if !requiresFinal(fd) && isTornHeader(crypt) {
+		// Published, but the header never reached the disk, possible when fsyncs are relaxed
+		return getBuffer(0), nil
+	}
+	if isChunked(crypt) {
+		plain, err = fs.openChunks(fd, crypt)
+	} else {
+		plain, err = fs.openLegacy(fd, crypt)
+	}
+	if err != nil {
+		if errors.Is(err, ErrAuthFailed) {
+			fs.metrics.authFailed()
+		}
+		return nil, corrupted(fd, err)
+	}
+	return plain, nil
+}
+
+func (fs *aesgcmStorage) Open(fd storage.FileDesc) (r storage.Reader, err error) {
+	ev := fs.traceStart(OpOpen, fd)
+	var n int
+	defer func() { fs.traceEnd(ev, int64(n), err) }()
 
-	crypt, err := ioutil.ReadAll(of)
+	fs.Log(fmt.Sprintf("opening %s", fd))
+	if !storage.FileDescOk(fd) {
+		return nil, storage.ErrInvalidFile
+	}
+
+	// Only the open file counter is touched under the lock, reading and decrypting run concurrently
+	if err := fs.acquire(); err != nil {
+		return nil, err
+	}
+	of, err := fs.openFile(fsGenName(fd), os.O_RDONLY, 0)
 	if err != nil {
+		fs.release()
 		return nil, err
 	}
 
-	nonce := make([]byte, fs.cyp.NonceSize())
-	copy(nonce[0:fs.cyp.NonceSize()], crypt[0:fs.cyp.NonceSize()])
-	plain, err := fs.cyp.Open(nil, nonce, crypt[fs.cyp.NonceSize():], fdGenAD(fd)) // TODO: Reuse same byte slice?
+	plain, err := fs.decryptFile(fd, of)
 	if err != nil {
+		of.Close()
+		fs.release()
+		if fs.quarantine {
+			fs.quarantineFile(fd, Cause(err))
+		}
 		return nil, err
 	}
-	fs.open += 1
-	return newReader(plain, fd, fs), nil
+	n = len(plain)
+	atomic.StoreInt32(&fs.keyOK, 1)
+	fs.metrics.readerOpened(1)
+	rd := newReader(of, plain, fd, fs)
+
+	// Adding this reader may have pushed usage over the budget
+	fs.budget.trim()
+	return rd, nil
 }
 
-func (fs *aesgcmStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
+func (fs *aesgcmStorage) Create(fd storage.FileDesc) (w storage.Writer, err error) {
+	ev := fs.traceStart(OpCreate, fd)
+	defer func() { fs.traceEnd(ev, 0, err) }()
+
 	fs.Log(fmt.Sprintf("create %s", fd))
 
 	if !storage.FileDescOk(fd) {
@@ -171,16 +393,16 @@ func (fs *aesgcmStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
 		return nil, errReadOnly
 	}
 
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-	if fs.open < 0 {
-		return nil, storage.ErrClosed
+	if err := fs.acquire(); err != nil {
+		return nil, err
 	}
-	of, err := os.OpenFile(filepath.Join(fs.path, fsGenName(fd)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	// Any previous version of the file stays in place until the new one is published
+	of, err := fs.openFile(fsGenPendingName(fd), os.O_RDWR|os.O_CREATE|os.O_TRUNC, fs.fileMode)
 	if err != nil {
+		fs.release()
 		return nil, err
 	}
-	fs.open++
+	fs.metrics.writerOpened(1)
 	return newWriter(of, fd, fs), nil
 }
 
@@ -196,6 +418,25 @@ func (fs *aesgcmStorage) Close() error {
 	if fs.open > 0 {
 		fs.Log(fmt.Sprintf("close: warning, %d files still open", fs.open))
 	}
+	var leakErr error
+	if leaked := fs.handles.list(); len(leaked) > 0 {
+		for i := range leaked {
+			fs.Log(fmt.Sprintf("close: leaked %s", &leaked[i]))
+		}
+		leakErr = &LeakError{Handles: leaked}
+	}
 	fs.open = -1
-	return fs.flock.release()
+	fs.syncer.stop()
+	if fs.coreDumps {
+		if err := restoreCoreDumps(); err != nil {
+			fs.Log(fmt.Sprintf("close: restore core dumps: %v", err))
+		}
+	}
+	if err := fs.dir.close(); err != nil {
+		fs.Log(fmt.Sprintf("close: directory: %v", err))
+	}
+	if err := fs.flock.release(); err != nil {
+		return err
+	}
+	return leakErr
 }
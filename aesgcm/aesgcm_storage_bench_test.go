@@ -0,0 +1,132 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_bench_test.go: Storage level benchmarks
+ *
+ * Run with several -cpu values to see how table opens scale, e.g.
+ *
+ *     go test -run XXX -bench Open -cpu 1,2,4,8 ./aesgcm
+ *
+ */
+
+package aesgcm
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	benchFiles    = 16
+	benchFileSize = 1 << 20
+)
+
+func benchStorage(b *testing.B) (Storage, func()) {
+	dir, err := ioutil.TempDir("", "aesgcm-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	fs, err := OpenEncryptedFile(dir, testKey, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, benchFileSize)
+	rand.Read(data)
+	for i := 0; i < benchFiles; i++ {
+		w, err := fs.Create(storage.FileDesc{Type: storage.TypeTable, Num: int64(i)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return fs, func() {
+		fs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// Opens (reads and decrypts) whole tables from as many goroutines as -cpu allows
+func BenchmarkOpen_Parallel(b *testing.B) {
+	fs, done := benchStorage(b)
+	defer done()
+
+	var next int64
+	b.SetBytes(benchFileSize)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			num := atomic.AddInt64(&next, 1) % benchFiles
+			r, err := fs.Open(storage.FileDesc{Type: storage.TypeTable, Num: num})
+			if err != nil {
+				// Not the test goroutine, so no Fatal
+				b.Error(err)
+				return
+			}
+			r.Close()
+		}
+	})
+}
+
+// GetMeta latency while other goroutines keep opening tables
+func BenchmarkGetMeta_DuringOpen(b *testing.B) {
+	fs, done := benchStorage(b)
+	defer done()
+
+	fd := storage.FileDesc{Type: storage.TypeManifest, Num: 1}
+	w, err := fs.Create(fd)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w.Write([]byte("TEST"))
+	w.Close()
+	if err := fs.SetMeta(fd); err != nil {
+		b.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if r, err := fs.Open(storage.FileDesc{Type: storage.TypeTable, Num: int64(i)}); err == nil {
+					r.Close()
+				}
+			}
+		}(i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fs.GetMeta(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
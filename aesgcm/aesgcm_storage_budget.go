@@ -0,0 +1,115 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_budget.go: Accounting and eviction of decrypted plaintext held by readers
+ *
+ */
+
+package aesgcm
+
+import (
+	"container/list"
+	"sync"
+)
+
+// memoryBudget tracks the plaintext held by every open reader of a storage. Readers holding plaintext are
+// kept in LRU order; when the total goes over the limit the least recently used ones drop their plaintext
+// and decrypt it again on their next read.
+//
+// Lock order: a reader's own mutex may be held while taking mu, but never the other way around.
+type memoryBudget struct {
+	limit   int64 // 0 means unlimited
+	metrics *Metrics
+
+	mu   sync.Mutex
+	used int64
+	lru  *list.List
+}
+
+func newMemoryBudget(limit int64, metrics *Metrics) *memoryBudget {
+	return &memoryBudget{
+		limit:   limit,
+		metrics: metrics,
+		lru:     list.New(),
+	}
+}
+
+// Usage returns the number of plaintext bytes currently held by readers
+func (b *memoryBudget) usage() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// add accounts for a reader which just decrypted its plaintext. Called with r.mu held.
+func (b *memoryBudget) add(r *aesgcmReader) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r.elem = b.lru.PushFront(r)
+	b.used += r.size
+	b.metrics.plaintextHeld(r.size)
+}
+
+// remove stops accounting for a reader which dropped its plaintext. Called with r.mu held.
+func (b *memoryBudget) remove(r *aesgcmReader) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.elem != nil {
+		b.lru.Remove(r.elem)
+		r.elem = nil
+		b.used -= r.size
+		b.metrics.plaintextHeld(-r.size)
+	}
+}
+
+// touch marks a reader as recently used
+func (b *memoryBudget) touch(r *aesgcmReader) {
+	if b.limit <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.elem != nil {
+		b.lru.MoveToFront(r.elem)
+	}
+}
+
+// trim evicts least recently used readers until usage is back under the limit. The most recently used
+// reader is never evicted, so a single file larger than the budget still works, it just isn't shared.
+// Must be called without holding any reader's mutex.
+func (b *memoryBudget) trim() {
+	if b.limit <= 0 {
+		return
+	}
+	var victims []*aesgcmReader
+	b.mu.Lock()
+	for b.used > b.limit && b.lru.Len() > 1 {
+		r := b.lru.Remove(b.lru.Back()).(*aesgcmReader)
+		r.elem = nil
+		b.used -= r.size
+		b.metrics.plaintextHeld(-r.size)
+		victims = append(victims, r)
+	}
+	b.mu.Unlock()
+
+	for _, r := range victims {
+		r.evict()
+		b.metrics.evicted()
+	}
+}
@@ -0,0 +1,110 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_budget_test.go: Memory budget for plaintext held by readers
+ *
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, fs storage.Storage, fd storage.FileDesc, data []byte) {
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryBudget_Evict(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	const size = 10000
+	fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{MemoryBudget: 2*size + size/2})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	contents := make([][]byte, 4)
+	readers := make([]storage.Reader, len(contents))
+	for i := range contents {
+		contents[i] = make([]byte, size)
+		rand.Read(contents[i])
+		fd := storage.FileDesc{Type: storage.TypeTable, Num: int64(i)}
+		writeTestFile(t, fs, fd, contents[i])
+		if readers[i], err = fs.Open(fd); err != nil {
+			t.Fatal(err)
+		}
+		if used := fs.MemoryUsage(); used > 2*size+size/2 {
+			t.Fatalf("usage %d over budget after opening %d files", used, i+1)
+		}
+	}
+	if ev := fs.Metrics().Snapshot().Evictions; ev != 2 {
+		t.Fatalf("expected 2 evictions, got %d", ev)
+	}
+
+	// Every reader, evicted or not, still returns its contents
+	for i, r := range readers {
+		buf := make([]byte, 100)
+		if _, err := r.ReadAt(buf, 500); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, contents[i][500:600]) {
+			t.Fatalf("reader %d returned wrong data", i)
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		all, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(all, contents[i]) {
+			t.Fatalf("reader %d returned wrong data", i)
+		}
+		if used := fs.MemoryUsage(); used > 2*size+size/2 {
+			t.Fatalf("usage %d over budget after reading file %d", used, i)
+		}
+	}
+
+	for _, r := range readers {
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if used := fs.MemoryUsage(); used != 0 {
+		t.Fatalf("expected no usage after closing every reader, got %d", used)
+	}
+}
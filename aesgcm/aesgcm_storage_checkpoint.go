@@ -0,0 +1,176 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_checkpoint.go: Point-in-time copies of an open storage
+ *
+ */
+
+package aesgcm
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// Checkpoint makes a copy of the storage in dir, which must not exist yet, that opens with the same key as
+// a database of its own. Files are sealed under their type and number only, so they are copied as they are:
+// tables, which are never modified once written, are hard-linked, or copied when dir is on another
+// filesystem, and the manifest and journals are copied. Removals wait until the copy is done, so every
+// file the manifest names is still there to be linked.
+//
+// Open journals and manifests are committed first, so the checkpoint holds everything written to the
+// database before the call, as if it had been synced. Writes made during the call may or may not be in it.
+// On failure dir is removed.
+func (fs *aesgcmStorage) Checkpoint(dir string) (err error) {
+	if err := fs.acquire(); err != nil {
+		return err
+	}
+	defer fs.release()
+
+	if err := os.Mkdir(dir, fs.dirMode); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			fs.Log(fmt.Sprintf("checkpoint %s: %v", dir, err))
+			os.RemoveAll(dir)
+		}
+	}()
+
+	dst, err := openDirHandle(dir)
+	if err != nil {
+		return err
+	}
+	defer dst.close()
+
+	fs.pauseRemove.Lock()
+	defer fs.pauseRemove.Unlock()
+
+	if err := fs.commitWriters(); err != nil {
+		return err
+	}
+
+	// The manifest before the journals: a journal newer than the manifest is replayed on open, while one
+	// the manifest had already moved past would be missing
+	meta, err := fs.GetMeta()
+	if err != nil {
+		return err
+	}
+	if err := fs.copyFile(fsGenName(meta), dst); err != nil {
+		return err
+	}
+	journals, err := fs.List(storage.TypeJournal)
+	if err != nil {
+		return err
+	}
+	for _, fd := range journals {
+		if err := fs.copyFile(fsGenName(fd), dst); err != nil {
+			return err
+		}
+	}
+	tables, err := fs.List(storage.TypeTable)
+	if err != nil {
+		return err
+	}
+	for _, fd := range tables {
+		if err := fs.linkFile(fsGenName(fd), dst); err != nil {
+			return err
+		}
+	}
+
+	// CURRENT is the only plaintext file
+	cur, err := openRegular(dst, "CURRENT", os.O_WRONLY|os.O_CREATE|os.O_EXCL, fs.fileMode)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(cur, fsGenName(meta))
+	if err == nil {
+		err = cur.Sync()
+	}
+	if cerr := cur.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return dst.sync()
+}
+
+// commitWriters seals and syncs whatever the open journal and manifest writers hold, publishing those
+// that were never synced
+func (fs *aesgcmStorage) commitWriters() error {
+	fs.mu.Lock()
+	writers := make([]*aesgcmWriter, 0, len(fs.writers))
+	for w := range fs.writers {
+		if w.fd.Type == storage.TypeJournal || w.fd.Type == storage.TypeManifest {
+			writers = append(writers, w)
+		}
+	}
+	fs.mu.Unlock()
+
+	for _, w := range writers {
+		w.mu.Lock()
+		var err error
+		if !w.closed {
+			err = w.commit(chunkCommit)
+		}
+		w.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies a file of the storage into dir, ciphertext as it is
+func (fs *aesgcmStorage) copyFile(name string, dir *dirHandle) error {
+	src, err := fs.openFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := openRegular(dir, name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fs.fileMode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// linkFile hard-links a file of the storage into dir, falling back to copying it when it can't be linked
+func (fs *aesgcmStorage) linkFile(name string, dir *dirHandle) error {
+	// A symlink would be linked as itself, so check first it is a regular file
+	if _, err := fs.statFile(name); err != nil {
+		return err
+	}
+	if err := fs.dir.link(name, dir); err != nil {
+		fs.Log(fmt.Sprintf("checkpoint: copying %s: %v", name, err))
+		return fs.copyFile(name, dir)
+	}
+	return nil
+}
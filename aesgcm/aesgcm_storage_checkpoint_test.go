@@ -0,0 +1,93 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_checkpoint_test.go: Point-in-time copies of an open storage
+ *
+ */
+
+package aesgcm
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+	cp := filepath.Join(temp, "checkpoint")
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	manifest := storage.FileDesc{Type: storage.TypeManifest, Num: 1}
+	table := storage.FileDesc{Type: storage.TypeTable, Num: 2}
+	journal := storage.FileDesc{Type: storage.TypeJournal, Num: 3}
+	writeTestFile(t, fs, manifest, []byte("manifest"))
+	if err := fs.SetMeta(manifest); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, fs, table, []byte("table"))
+
+	// Open and never synced when the checkpoint is taken
+	w, err := fs.Create(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Checkpoint(cp); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if _, err := w.Write([]byte(" second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := readTestFile(fs, journal); err != nil || string(b) != "first second" {
+		t.Fatalf("expected the journal to carry on after the checkpoint, got %q, %v", b, err)
+	}
+
+	a, err1 := os.Stat(filepath.Join(temp, fsGenName(table)))
+	b, err2 := os.Stat(filepath.Join(cp, fsGenName(table)))
+	if err1 != nil || err2 != nil || !os.SameFile(a, b) {
+		t.Fatalf("expected the table to be hard-linked, got %v, %v", err1, err2)
+	}
+
+	cfs, err := OpenEncryptedFile(cp, testKey, true)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer cfs.Close()
+	if fd, err := cfs.GetMeta(); err != nil || fd != manifest {
+		t.Fatalf("expected the checkpoint to point at %s, got %s, %v", manifest, fd, err)
+	}
+	for fd, want := range map[storage.FileDesc]string{manifest: "manifest", table: "table", journal: "first"} {
+		if b, err := readTestFile(cfs, fd); err != nil || string(b) != want {
+			t.Fatalf("expected %s to read %q from the checkpoint, got %q, %v", fd, want, b, err)
+		}
+	}
+}
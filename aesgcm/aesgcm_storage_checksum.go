@@ -0,0 +1,181 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_checksum.go: Keyless integrity checks of encrypted files
+ *
+ */
+
+package aesgcm
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// ChecksumReport is the result of checking the checksums of a single file
+type ChecksumReport struct {
+	Fd   storage.FileDesc
+	Size int64
+	// Chunks whose checksum was checked
+	Chunks int
+	// Set for files written before checksums were added. Only their layout could be checked.
+	Unverifiable bool
+	// Bytes of a journal or manifest after its last commit point, which were never synced and are ignored
+	// when reading it
+	TornBytes int64
+	// Why the file is damaged, a *storage.ErrCorrupted like Open returns, or nil
+	Err error
+}
+
+// VerifyChecksums checks the checksums and layout of every file of the database at dir, without the key and
+// without decrypting anything, so it can be run by whoever looks after the disks. Damage it finds is
+// certain, but files passing it can still fail authentication, as checksums don't protect against
+// deliberate changes; use Verify on an open storage for that. The database may be open while this runs,
+// files being written may then be reported as torn.
+//
+// An error is only returned when dir can't be listed. Files that can't be read are reported with their
+// error, as are files over 1GiB, the default Options.MaxFileSize, with ErrFileTooLarge.
+func VerifyChecksums(dir string) ([]ChecksumReport, error) {
+	names, err := readDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	d, err := openDirHandle(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.close()
+	var fds []storage.FileDesc
+	for _, name := range names {
+		if fd, ok := fsParseName(name); ok {
+			fds = append(fds, fd)
+		}
+	}
+	sort.Slice(fds, func(i, j int) bool {
+		if fds[i].Type != fds[j].Type {
+			return fds[i].Type < fds[j].Type
+		}
+		return fds[i].Num < fds[j].Num
+	})
+
+	reports := make([]ChecksumReport, 0, len(fds))
+	for _, fd := range fds {
+		reports = append(reports, checkNamedFile(d, fd))
+	}
+	return reports, nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(infos))
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+func checkNamedFile(d *dirHandle, fd storage.FileDesc) ChecksumReport {
+	f, err := openRegular(d, fsGenName(fd), os.O_RDONLY, 0)
+	if err != nil {
+		return ChecksumReport{Fd: fd, Err: err}
+	}
+	defer f.Close()
+	crypt, err := readCiphertext(fd, f, defaultMaxFileSize)
+	if err != nil {
+		return ChecksumReport{Fd: fd, Err: err}
+	}
+	defer putBuffer(crypt)
+	return checkFile(fd, crypt)
+}
+
+// checkFile checks a file the way Open reads it, short of decrypting
+func checkFile(fd storage.FileDesc, crypt []byte) ChecksumReport {
+	r := ChecksumReport{Fd: fd, Size: int64(len(crypt))}
+	strict := requiresFinal(fd)
+	if !strict && isTornHeader(crypt) {
+		r.TornBytes = int64(len(crypt))
+		return r
+	}
+	if !isChunked(crypt) {
+		r.Unverifiable = true
+		return r
+	}
+	chunkSize, version, err := parseHeader(fd, crypt)
+	if err != nil {
+		r.Err = corrupted(fd, err)
+		return r
+	}
+	r.Unverifiable = version < 2
+
+	var (
+		damaged   error
+		committed int // end of the last commit point
+		final     bool
+		index     int64
+	)
+	off := headerLen(version)
+	for off < len(crypt) && !final {
+		ref, err := parseChunk(crypt, off, chunkSize, version)
+		if err != nil {
+			// Only a last chunk running past the end of the file is a torn tail, as for scanChunks
+			if strict || !isTornTail(err) {
+				r.Err = corrupted(fd, err)
+				return r
+			}
+			break
+		}
+		if !r.Unverifiable {
+			r.Chunks++
+			if damaged == nil && !checksumOK(crypt[ref.off:ref.end(version)]) {
+				damaged = &AuthError{Fd: fd, Chunk: index, Err: ErrChecksum}
+			}
+		}
+		off = ref.end(version)
+		final = ref.flags&chunkFinal != 0
+		if ref.flags&(chunkFinal|chunkCommit) != 0 {
+			committed = off
+			// Damage before a commit point is read back, after it it's part of the ignored tail
+			if damaged != nil {
+				r.Err = corrupted(fd, damaged)
+				return r
+			}
+		}
+		index++
+	}
+	switch {
+	case final && off < len(crypt):
+		r.Err = corrupted(fd, errTrailingBytes)
+	case strict && !final:
+		r.Err = corrupted(fd, ErrTruncated)
+	case !strict:
+		if committed == 0 {
+			committed = headerLen(version)
+		}
+		r.TornBytes = int64(len(crypt) - committed)
+	}
+	return r
+}
@@ -0,0 +1,140 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_checksum_test.go: Keyless integrity checks of encrypted files
+ *
+ */
+
+package aesgcm
+
+import (
+	"errors"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyChecksums(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	good := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	flipped := storage.FileDesc{Type: storage.TypeTable, Num: 2}
+	truncated := storage.FileDesc{Type: storage.TypeTable, Num: 3}
+	for _, fd := range []storage.FileDesc{good, flipped, truncated} {
+		writeTestFile(t, fs, fd, make([]byte, 3*defaultChunkSize))
+	}
+	journal := storage.FileDesc{Type: storage.TypeJournal, Num: 4}
+	badLength := storage.FileDesc{Type: storage.TypeJournal, Num: 5}
+	for _, fd := range []storage.FileDesc{journal, badLength} {
+		w, err := fs.Create(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("synced"))
+		if err := w.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("not synced"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.Close()
+
+	tamper := func(fd storage.FileDesc, f func(b []byte) []byte) {
+		name := filepath.Join(temp, fsGenName(fd))
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, f(b), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdr := headerLen(formatVersion)
+	chunk := chunkOverhead(formatVersion) + defaultChunkSize
+	tamper(flipped, func(b []byte) []byte {
+		b[hdr+chunk+100] ^= 1
+		return b
+	})
+	tamper(truncated, func(b []byte) []byte { return b[:len(b)-10] })
+	// The journal loses the end of the chunk written by Close, after the commit made by Sync
+	tamper(journal, func(b []byte) []byte { return b[:len(b)-5] })
+	// An impossible length in the first chunk is damage, not a torn tail
+	tamper(badLength, func(b []byte) []byte {
+		copy(b[hdr+1:], []byte{0xff, 0xff, 0xff, 0xff})
+		return b
+	})
+
+	reports, err := VerifyChecksums(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 5 {
+		t.Fatalf("expected 5 files, got %+v", reports)
+	}
+	byFd := make(map[storage.FileDesc]ChecksumReport)
+	for _, r := range reports {
+		byFd[r.Fd] = r
+	}
+
+	if r := byFd[good]; r.Err != nil || r.Chunks != 3 || r.Unverifiable || r.TornBytes != 0 {
+		t.Fatalf("expected the intact table to pass, got %+v", r)
+	}
+	r := byFd[flipped]
+	var aerr *AuthError
+	if !lerrors.IsCorrupted(r.Err) || !errors.As(Cause(r.Err), &aerr) || aerr.Chunk != 1 || !errors.Is(aerr, ErrChecksum) {
+		t.Fatalf("expected a checksum failure of chunk 1, got %v", r.Err)
+	}
+	if r := byFd[truncated]; !errors.Is(Cause(r.Err), ErrTruncated) {
+		t.Fatalf("expected the truncated table to be reported, got %v", r.Err)
+	}
+	if r := byFd[journal]; r.Err != nil || r.TornBytes == 0 {
+		t.Fatalf("expected the journal to pass with a torn tail, got %+v", r)
+	}
+	if r := byFd[badLength]; !lerrors.IsCorrupted(r.Err) || r.TornBytes != 0 {
+		t.Fatalf("expected the damaged journal to be reported, got %+v", r)
+	}
+}
+
+func TestVerifyChecksums_Legacy(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	// Anything not starting with the magic is read as a file written before chunking
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	if err := ioutil.WriteFile(filepath.Join(temp, fsGenName(fd)), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reports, err := VerifyChecksums(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || !reports[0].Unverifiable || reports[0].Err != nil {
+		t.Fatalf("expected the file to be unverifiable, got %+v", reports)
+	}
+}
@@ -0,0 +1,168 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_cipher.go: Cipher suites and key sources
+ *
+ */
+
+package aesgcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// CipherSuite selects the cipher files are sealed with. Every suite is AES in GCM mode, the only one the
+// file format knows, and they differ in the key length they insist on.
+type CipherSuite int
+
+const (
+	// CipherAESGCM picks AES-128, AES-192 or AES-256 from the length of the key, 16, 24 or 32 bytes.
+	CipherAESGCM CipherSuite = iota
+
+	// CipherAES128GCM, CipherAES192GCM and CipherAES256GCM only accept keys of their length, so that a
+	// short key can't silently weaken the encryption.
+	CipherAES128GCM
+	CipherAES192GCM
+	CipherAES256GCM
+)
+
+var cipherSuiteNames = []string{"aes-gcm", "aes-128-gcm", "aes-192-gcm", "aes-256-gcm"}
+
+func (c CipherSuite) String() string {
+	if c >= 0 && int(c) < len(cipherSuiteNames) {
+		return cipherSuiteNames[c]
+	}
+	return fmt.Sprintf("CipherSuite(%d)", int(c))
+}
+
+// keyLen is the key length the suite requires, or 0 for any AES key length
+func (c CipherSuite) keyLen() int {
+	switch c {
+	case CipherAES128GCM:
+		return 16
+	case CipherAES192GCM:
+		return 24
+	case CipherAES256GCM:
+		return 32
+	}
+	return 0
+}
+
+func newCipher(suite CipherSuite, key []byte) (cipher.AEAD, error) {
+	if n := suite.keyLen(); n != 0 && len(key) != n {
+		return nil, fmt.Errorf("leveldb/aesgcm: %s needs a %d byte key, got %d bytes", suite, n, len(key))
+	}
+	ace, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(ace)
+}
+
+// KeySource supplies the key when the storage is opened, e.g. from a keyring or a key management service,
+// so the caller never holds it. The storage wipes the returned slice once it has set up the cipher.
+type KeySource interface {
+	Key() ([]byte, error)
+}
+
+// KeyFunc adapts a function to a KeySource
+type KeyFunc func() ([]byte, error)
+
+func (f KeyFunc) Key() ([]byte, error) {
+	return f()
+}
+
+var errKeyAndSource = errors.New("leveldb/aesgcm: both a key and a KeySource given")
+
+// Logger receives everything logged through the storage's Log: goleveldb's own messages and the storage's
+type Logger interface {
+	Log(str string)
+}
+
+func (fs *aesgcmStorage) CheckKey() error {
+	_, err := fs.keyConfirmed()
+	return err
+}
+
+// keyConfirmed checks the key against the storage's files, the manifest first, until one authenticates.
+// Returns whether one did, and if none did, the error of a file sealed under another key, if any.
+func (fs *aesgcmStorage) keyConfirmed() (bool, error) {
+	if atomic.LoadInt32(&fs.keyOK) != 0 {
+		return true, nil
+	}
+	var fds []storage.FileDesc
+	if fd, err := fs.GetMeta(); err == nil {
+		fds = append(fds, fd)
+	}
+	all, err := fs.List(storage.TypeAll)
+	if err != nil {
+		return false, err
+	}
+	fds = append(fds, all...)
+
+	var wrongKey error
+	for _, fd := range fds {
+		err := fs.checkKeyOn(fd)
+		if err == nil {
+			atomic.StoreInt32(&fs.keyOK, 1)
+			return true, nil
+		}
+		if wrongKey == nil && errors.Is(err, ErrWrongKey) {
+			wrongKey = err
+		}
+	}
+	return false, wrongKey
+}
+
+// checkKeyOn authenticates the header of a file. Files written before chunking have none, so only a
+// manifest, which is small, is decrypted whole instead. A failure of one of those can't be told apart
+// from damage.
+func (fs *aesgcmStorage) checkKeyOn(fd storage.FileDesc) error {
+	of, err := fs.openFile(fsGenName(fd), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer of.Close()
+	h := make([]byte, headerLen(formatVersion))
+	n, err := of.ReadAt(h, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if h = h[:n]; isChunked(h) {
+		_, _, err = fs.openHeader(fd, h)
+		return err
+	}
+	if fd.Type != storage.TypeManifest {
+		return errBadHeader
+	}
+	plain, err := fs.decryptFile(fd, of)
+	if err != nil {
+		return err
+	}
+	putBuffer(plain)
+	return nil
+}
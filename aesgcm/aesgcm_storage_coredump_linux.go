@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_coredump_linux.go: Core dump control on Linux
+ *
+ */
+
+package aesgcm
+
+import (
+	"sync"
+	"syscall"
+)
+
+var coreDumps struct {
+	sync.Mutex
+	refs     int
+	rlimit   syscall.Rlimit
+	dumpable bool
+}
+
+// disableCoreDumps stops the process from writing core dumps, by lowering the soft RLIMIT_CORE to zero and
+// clearing the dumpable flag, until every caller has called restoreCoreDumps.
+func disableCoreDumps() error {
+	coreDumps.Lock()
+	defer coreDumps.Unlock()
+	if coreDumps.refs == 0 {
+		var rl syscall.Rlimit
+		if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &rl); err != nil {
+			return err
+		}
+		// Only the soft limit is lowered, so it can be raised back later without privileges
+		if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{Cur: 0, Max: rl.Max}); err != nil {
+			return err
+		}
+		dumpable, _, _ := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_GET_DUMPABLE, 0, 0)
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_DUMPABLE, 0, 0); errno != 0 {
+			syscall.Setrlimit(syscall.RLIMIT_CORE, &rl)
+			return errno
+		}
+		coreDumps.rlimit = rl
+		coreDumps.dumpable = dumpable == 1
+	}
+	coreDumps.refs++
+	return nil
+}
+
+func restoreCoreDumps() error {
+	coreDumps.Lock()
+	defer coreDumps.Unlock()
+	if coreDumps.refs == 0 {
+		return nil
+	}
+	coreDumps.refs--
+	if coreDumps.refs > 0 {
+		return nil
+	}
+	if coreDumps.dumpable {
+		syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_DUMPABLE, 1, 0)
+	}
+	return syscall.Setrlimit(syscall.RLIMIT_CORE, &coreDumps.rlimit)
+}
@@ -0,0 +1,85 @@
+//go:build linux
+// +build linux
+
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_coredump_linux_test.go: Core dump control
+ *
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestOpenEncryptedFile_DisableCoreDumps(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	var before, rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &before); err != nil {
+		t.Fatal(err)
+	}
+
+	key := append([]byte(nil), testKey...)
+	fs, err := OpenEncryptedFileWithOptions(temp, key, &Options{DisableCoreDumps: true})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &rl); err != nil {
+		t.Fatal(err)
+	}
+	if rl.Cur != 0 {
+		t.Fatalf("expected core dumps to be disabled, soft limit is %d", rl.Cur)
+	}
+
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	writeTestFile(t, fs, fd, []byte("TEST"))
+	r, err := fs.Open(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(b, []byte("TEST")) {
+		t.Fatalf("unexpected contents %q (%v)", b, err)
+	}
+	r.Close()
+
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, testKey) {
+		t.Fatal("caller's key must be left alone")
+	}
+
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &rl); err != nil {
+		t.Fatal(err)
+	}
+	if rl != before {
+		t.Fatalf("core limit not restored, expected %+v, got %+v", before, rl)
+	}
+}
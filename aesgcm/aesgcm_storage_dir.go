@@ -0,0 +1,117 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_dir.go: Opening and reading files of a possibly hostile database directory
+ *
+ */
+
+package aesgcm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// Largest CURRENT file read: a manifest name and a newline
+const maxCurrentSize = 256
+
+var errNotRegular = errors.New("leveldb/aesgcm: not a regular file")
+
+// ErrFileTooLarge is returned when reading a file larger than Options.MaxFileSize. Files are read whole,
+// so this keeps a planted or runaway file from exhausting memory. It isn't treated as corruption.
+var ErrFileTooLarge = errors.New("leveldb/aesgcm: file too large")
+
+// openFile opens a file of the storage directory by name, never following a symlink, and refuses anything
+// but a regular file
+func (fs *aesgcmStorage) openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return openRegular(fs.dir, name, flag, perm)
+}
+
+func openRegular(d *dirHandle, name string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := d.open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: errNotRegular}
+	}
+	return f, nil
+}
+
+// statFile stats a file of the storage directory without following a symlink, refusing anything but a
+// regular file
+func (fs *aesgcmStorage) statFile(name string) (os.FileInfo, error) {
+	f, err := fs.openFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// readCiphertext reads the whole of an open file into a pooled buffer, after checking its size is one
+// that can be allocated
+func (fs *aesgcmStorage) readCiphertext(fd storage.FileDesc, of *os.File) ([]byte, error) {
+	return readCiphertext(fd, of, fs.maxFileSize)
+}
+
+func readCiphertext(fd storage.FileDesc, of *os.File, max int64) ([]byte, error) {
+	fi, err := of.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() > max {
+		return nil, fmt.Errorf("%w: %s is %d bytes", ErrFileTooLarge, fd, fi.Size())
+	}
+	crypt := getBuffer(int(fi.Size()))
+	n, err := of.ReadAt(crypt, 0)
+	if err != nil && err != io.EOF {
+		putBuffer(crypt)
+		return nil, err
+	}
+	// Shrunk since the Stat
+	return crypt[:n], nil
+}
+
+// readSmallFile reads a file of the storage directory of at most max bytes
+func (fs *aesgcmStorage) readSmallFile(name string, max int64) ([]byte, error) {
+	f, err := fs.openFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, fmt.Errorf("%w: %s is over %d bytes", ErrFileTooLarge, name, max)
+	}
+	return b, nil
+}
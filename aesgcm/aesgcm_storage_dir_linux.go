@@ -0,0 +1,135 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_dir_linux.go: Working on files relative to the database directory on Linux
+ *
+ */
+
+package aesgcm
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// dirHandle is an open descriptor of the database directory. Everything the storage does in the directory
+// goes through it: files are opened, created, removed, renamed and linked, the listing read, subdirectories
+// made, and the directory synced, all relative to the descriptor. None of it can be redirected by renaming
+// or replacing the directory, or a symlink on the way to it, after the storage was opened.
+type dirHandle struct {
+	fd int
+}
+
+func openDirHandle(path string) (*dirHandle, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return &dirHandle{fd: fd}, nil
+}
+
+// open opens name, which must be a plain name inside the directory, never following a symlink in its
+// place. A FIFO or device in its place doesn't block the open, and is then refused by openFile.
+func (d *dirHandle) open(name string, flag int, perm os.FileMode) (*os.File, error) {
+	fd, err := syscall.Openat(d.fd, name, flag|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if err := syscall.SetNonblock(fd, false); err != nil {
+		syscall.Close(fd)
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// subdir opens the subdirectory name, never following a symlink in its place, and first creates it with
+// perm when create is set
+func (d *dirHandle) subdir(name string, perm os.FileMode, create bool) (*dirHandle, error) {
+	if create {
+		if err := syscall.Mkdirat(d.fd, name, uint32(perm.Perm())); err != nil && err != syscall.EEXIST {
+			return nil, &os.PathError{Op: "mkdir", Path: name, Err: err}
+		}
+	}
+	fd, err := syscall.Openat(d.fd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &dirHandle{fd: fd}, nil
+}
+
+// names lists the directory. It is read through a descriptor of its own, so concurrent listings don't
+// share an offset.
+func (d *dirHandle) names() ([]string, error) {
+	fd, err := syscall.Openat(d.fd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: ".", Err: err}
+	}
+	f := os.NewFile(uintptr(fd), ".")
+	defer f.Close()
+	return f.Readdirnames(0)
+}
+
+func (d *dirHandle) remove(name string) error {
+	if err := syscall.Unlinkat(d.fd, name); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// rename renames oldname to newname within the directory, replacing newname
+func (d *dirHandle) rename(oldname, newname string) error {
+	return d.move(oldname, d, newname)
+}
+
+// move renames name to newname in the directory to, replacing newname
+func (d *dirHandle) move(name string, to *dirHandle, newname string) error {
+	if err := syscall.Renameat(d.fd, name, to.fd, newname); err != nil {
+		return &os.LinkError{Op: "rename", Old: name, New: newname, Err: err}
+	}
+	return nil
+}
+
+// link hard-links name into the directory to, under the same name. A symlink is linked as itself, never
+// followed.
+func (d *dirHandle) link(name string, to *dirHandle) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	// Not exported by the syscall package
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(d.fd), uintptr(unsafe.Pointer(p)), uintptr(to.fd), uintptr(unsafe.Pointer(p)), 0, 0)
+	if errno != 0 {
+		return &os.LinkError{Op: "link", Old: name, New: name, Err: errno}
+	}
+	return nil
+}
+
+// sync makes the directory's entries durable. Some filesystems refuse to sync a directory, that is not an
+// error.
+func (d *dirHandle) sync() error {
+	if err := syscall.Fsync(d.fd); err != nil && err != syscall.EINVAL {
+		return &os.PathError{Op: "sync", Path: ".", Err: err}
+	}
+	return nil
+}
+
+func (d *dirHandle) close() error {
+	return syscall.Close(d.fd)
+}
@@ -0,0 +1,91 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_dir_linux_test.go: Working through the directory handle after the directory moved
+ *
+ */
+
+package aesgcm
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDir_Moved(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	path := filepath.Join(temp, "db")
+	fs, err := OpenEncryptedFile(path, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+	old := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	writeTestFile(t, fs, old, []byte("old"))
+
+	// Move the directory away and put another in its place
+	moved := filepath.Join(temp, "moved")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	table := storage.FileDesc{Type: storage.TypeTable, Num: 2}
+	writeTestFile(t, fs, table, []byte("table"))
+	meta := storage.FileDesc{Type: storage.TypeManifest, Num: 3}
+	writeTestFile(t, fs, meta, []byte("manifest"))
+	if err := fs.SetMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	fds, err := fs.List(storage.TypeTable)
+	if err != nil || len(fds) != 2 {
+		t.Fatalf("expected both tables listed, got %v (%v)", fds, err)
+	}
+	if err := fs.Remove(old); err != nil {
+		t.Fatal(err)
+	}
+	ckpt := filepath.Join(temp, "checkpoint")
+	if err := fs.(*aesgcmStorage).Checkpoint(ckpt); err != nil {
+		t.Fatal(err)
+	}
+
+	if fis, err := ioutil.ReadDir(path); err != nil || len(fis) != 0 {
+		t.Fatalf("expected nothing in the new directory, got %d files (%v)", len(fis), err)
+	}
+	for name, want := range map[string]bool{fsGenName(old): false, fsGenName(table): true, fsGenName(meta): true, "CURRENT": true} {
+		if _, err := os.Lstat(filepath.Join(moved, name)); (err == nil) != want {
+			t.Fatalf("%s: expected present %v in the moved directory, got %v", name, want, err)
+		}
+	}
+	ck, err := OpenEncryptedFile(ckpt, testKey, true)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer ck.Close()
+	if got, err := readTestFile(ck, table); err != nil || string(got) != "table" {
+		t.Fatalf("expected the checkpoint to hold the table, got %q (%v)", got, err)
+	}
+}
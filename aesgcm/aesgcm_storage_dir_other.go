@@ -0,0 +1,121 @@
+//go:build !linux
+// +build !linux
+
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_dir_other.go: Working on files inside the database directory elsewhere than on Linux
+ *
+ */
+
+package aesgcm
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// dirHandle names the database directory. Without openat, files are opened by path, and anything but a
+// regular file in their place is refused by checking the name before opening, so a FIFO can't block the
+// open, and the opened file against it after. Everything else goes by path too, and acts on whatever
+// directory is at the path by then.
+type dirHandle struct {
+	path string
+}
+
+func openDirHandle(path string) (*dirHandle, error) {
+	return &dirHandle{path: path}, nil
+}
+
+func (d *dirHandle) open(name string, flag int, perm os.FileMode) (*os.File, error) {
+	path := filepath.Join(d.path, name)
+	before, err := os.Lstat(path)
+	if err == nil && !before.Mode().IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: errNotRegular}
+	} else if err != nil && (flag&os.O_CREATE == 0 || !os.IsNotExist(err)) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	after, err := os.Lstat(path)
+	if err != nil || !after.Mode().IsRegular() {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: path, Err: errNotRegular}
+	}
+	if fi, err := f.Stat(); err != nil || !os.SameFile(fi, after) {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: path, Err: errNotRegular}
+	}
+	return f, nil
+}
+
+// subdir names the subdirectory name, and first creates it with perm when create is set. A symlink in its
+// place is refused.
+func (d *dirHandle) subdir(name string, perm os.FileMode, create bool) (*dirHandle, error) {
+	path := filepath.Join(d.path, name)
+	if create {
+		if err := os.Mkdir(path, perm); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.ENOTDIR}
+	}
+	return &dirHandle{path: path}, nil
+}
+
+func (d *dirHandle) names() ([]string, error) {
+	f, err := os.Open(d.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(0)
+}
+
+func (d *dirHandle) remove(name string) error {
+	return os.Remove(filepath.Join(d.path, name))
+}
+
+func (d *dirHandle) rename(oldname, newname string) error {
+	return d.move(oldname, d, newname)
+}
+
+func (d *dirHandle) move(name string, to *dirHandle, newname string) error {
+	return rename(filepath.Join(d.path, name), filepath.Join(to.path, newname))
+}
+
+func (d *dirHandle) link(name string, to *dirHandle) error {
+	return os.Link(filepath.Join(d.path, name), filepath.Join(to.path, name))
+}
+
+func (d *dirHandle) sync() error {
+	return syncDir(d.path)
+}
+
+func (d *dirHandle) close() error {
+	return nil
+}
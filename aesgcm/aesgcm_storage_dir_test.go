@@ -0,0 +1,133 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_dir_test.go: Opening and reading files of a hostile database directory
+ *
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDir_NotRegular(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	target := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	writeTestFile(t, fs, target, []byte("data"))
+
+	// A symlink to a good file, and a FIFO which would block a plain open
+	link := storage.FileDesc{Type: storage.TypeTable, Num: 2}
+	if err := os.Symlink(fsGenName(target), filepath.Join(temp, fsGenName(link))); err != nil {
+		t.Fatal(err)
+	}
+	fifo := storage.FileDesc{Type: storage.TypeTable, Num: 3}
+	if err := syscall.Mkfifo(filepath.Join(temp, fsGenName(fifo)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range []storage.FileDesc{link, fifo} {
+		if _, err := fs.Open(fd); err == nil {
+			t.Fatalf("%s: expected anything but a regular file to be refused", fd)
+		}
+		if _, err := fs.(*aesgcmStorage).Verify(fd); err == nil {
+			t.Fatalf("%s: expected Verify to refuse it too", fd)
+		}
+	}
+
+	// Nor are symlinks followed when creating
+	created := storage.FileDesc{Type: storage.TypeTable, Num: 4}
+	outside := filepath.Join(temp, "outside")
+	if err := os.Symlink(outside, filepath.Join(temp, fsGenPendingName(created))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Create(created); err == nil {
+		t.Fatal("expected Create not to follow a symlink")
+	}
+	if _, err := os.Lstat(outside); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be written through the symlink, got %v", err)
+	}
+}
+
+func TestDir_SizeCaps(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{MaxFileSize: 1000})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	small := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	large := storage.FileDesc{Type: storage.TypeTable, Num: 2}
+	writeTestFile(t, fs, small, []byte("data"))
+	writeTestFile(t, fs, large, make([]byte, 1000))
+	if got, err := readTestFile(fs, small); err != nil || string(got) != "data" {
+		t.Fatalf("expected the small file back, got %q and %v", got, err)
+	}
+	if _, err := fs.Open(large); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected the large file to be refused, got %v", err)
+	}
+
+	// An oversized CURRENT is treated as corrupted, and the backup used
+	manifest := storage.FileDesc{Type: storage.TypeManifest, Num: 3}
+	writeTestFile(t, fs, manifest, []byte("manifest"))
+	if err := ioutil.WriteFile(filepath.Join(temp, "CURRENT.bak"), []byte(fsGenName(manifest)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	huge := append([]byte(fsGenName(manifest)), bytes.Repeat([]byte{' '}, 1<<20)...)
+	if err := ioutil.WriteFile(filepath.Join(temp, "CURRENT"), append(huge, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if fd, err := fs.GetMeta(); err != nil || fd != manifest {
+		t.Fatalf("expected the backup to be used, got %s and %v", fd, err)
+	}
+}
+
+func TestDir_ParseName(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"000001.ldb":      true,
+		"1234567.log":     true,
+		"MANIFEST-000002": true,
+		"1.ldb":           false,
+		"-00001.ldb":      false,
+		"+00001.ldb":      false,
+		"MANIFEST-2":      false,
+		"000001.ldb.bak":  false,
+	} {
+		if _, got := fsParseName(name); got != ok {
+			t.Errorf("%s: expected %v, got %v", name, ok, got)
+		}
+	}
+}
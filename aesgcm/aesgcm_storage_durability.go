@@ -0,0 +1,134 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_durability.go: Durability modes and the interval syncer of the relaxed mode
+ *
+ */
+
+package aesgcm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Durability selects how much work a writer's Sync does to make its data survive a crash
+type Durability int
+
+const (
+	// DurabilityStandard fsyncs the file on every Sync, and the directory when a file is first published
+	// and on every manifest Sync.
+	DurabilityStandard Durability = iota
+
+	// DurabilityStrict fsyncs both the file and the directory on every Sync, whatever the file type.
+	DurabilityStrict
+
+	// DurabilityRelaxed only writes journals out on Sync, and fsyncs them in batches every SyncInterval.
+	// Writes acknowledged in the last interval may be lost in a crash, but the database still opens.
+	// Manifests and tables, which the database can't open without, are synced as in standard mode.
+	DurabilityRelaxed
+)
+
+var durabilityNames = []string{"standard", "strict", "relaxed"}
+
+func (d Durability) String() string {
+	if d >= 0 && int(d) < len(durabilityNames) {
+		return durabilityNames[d]
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// intervalSyncer fsyncs the writers that had a Sync since its last round, every interval
+type intervalSyncer struct {
+	fs *aesgcmStorage
+
+	// Held while syncing, so a writer can't close its file halfway through a round
+	mu    sync.Mutex
+	dirty map[*aesgcmWriter]struct{}
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newIntervalSyncer(fs *aesgcmStorage, interval time.Duration) *intervalSyncer {
+	s := &intervalSyncer{
+		fs:    fs,
+		dirty: make(map[*aesgcmWriter]struct{}),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go s.run(interval)
+	return s
+}
+
+func (s *intervalSyncer) run(interval time.Duration) {
+	defer close(s.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.syncAll()
+		case <-s.quit:
+			s.syncAll()
+			return
+		}
+	}
+}
+
+func (s *intervalSyncer) syncAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.dirty {
+		start := time.Now()
+		err := w.fp.Sync()
+		s.fs.metrics.synced(time.Since(start))
+		if err != nil {
+			s.fs.Log(fmt.Sprintf("sync %s: %v", w.fd, err))
+		}
+		delete(s.dirty, w)
+	}
+}
+
+// add schedules w for the next round
+func (s *intervalSyncer) add(w *aesgcmWriter) {
+	s.mu.Lock()
+	s.dirty[w] = struct{}{}
+	s.mu.Unlock()
+}
+
+// remove unschedules w, which is about to close its file, waiting for a round in progress to finish
+func (s *intervalSyncer) remove(w *aesgcmWriter) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.dirty, w)
+	s.mu.Unlock()
+}
+
+// stop runs a last round and stops the syncer
+func (s *intervalSyncer) stop() {
+	if s == nil {
+		return
+	}
+	close(s.quit)
+	<-s.done
+}
@@ -0,0 +1,140 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_durability_test.go: Durability modes
+ *
+ */
+
+package aesgcm
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDurability_Modes(t *testing.T) {
+	for _, d := range []Durability{DurabilityStandard, DurabilityStrict, DurabilityRelaxed} {
+		t.Run(d.String(), func(t *testing.T) {
+			temp := tempDir(t)
+			defer os.RemoveAll(temp)
+
+			fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{Durability: d, SyncInterval: 10 * time.Millisecond})
+			if err != nil {
+				t.Fatal("OpenFile: got error: ", err)
+			}
+			defer fs.Close()
+
+			for _, ft := range []storage.FileType{storage.TypeJournal, storage.TypeManifest, storage.TypeTable} {
+				fd := storage.FileDesc{Type: ft, Num: 1}
+				w, err := fs.Create(fd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 3; i++ {
+					if _, err := w.Write([]byte("record")); err != nil {
+						t.Fatal(err)
+					}
+					if err := w.Sync(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if ft != storage.TypeTable {
+					if got, err := readTestFile(fs, fd); err != nil || string(got) != "recordrecordrecord" {
+						t.Fatalf("%s: expected the synced contents before close, got %q, %v", fd, got, err)
+					}
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if got, err := readTestFile(fs, fd); err != nil || string(got) != "recordrecordrecord" {
+					t.Fatalf("%s: got %q, %v", fd, got, err)
+				}
+			}
+
+			if fs.Metrics().Snapshot().SyncLatency.Count == 0 {
+				t.Fatal("expected syncs to be recorded")
+			}
+		})
+	}
+}
+
+func TestDurability_RelaxedBatches(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{Durability: DurabilityRelaxed, SyncInterval: time.Hour})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+
+	fd := storage.FileDesc{Type: storage.TypeJournal, Num: 1}
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("record")); err != nil {
+		t.Fatal(err)
+	}
+	before := fs.Metrics().Snapshot().SyncLatency.Count
+	for i := 0; i < 10; i++ {
+		if err := w.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only publishing the journal synced the directory, the file itself waits for the syncer
+	if n := fs.Metrics().Snapshot().SyncLatency.Count - before; n != 1 {
+		t.Fatalf("expected a single directory sync, got %d syncs", n)
+	}
+
+	// Closing the storage runs the pending round
+	fs.Close()
+	if n := fs.Metrics().Snapshot().SyncLatency.Count - before; n != 2 {
+		t.Fatalf("expected the journal to be synced on close, got %d syncs", n)
+	}
+	w.Close()
+}
+
+func TestDurability_TornHeader(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	journal := storage.FileDesc{Type: storage.TypeJournal, Num: 2}
+	table := storage.FileDesc{Type: storage.TypeTable, Num: 2}
+	for _, fd := range []storage.FileDesc{journal, table} {
+		if err := ioutil.WriteFile(filepath.Join(temp, fsGenName(fd)), formatMagic[:5], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := readTestFile(fs, journal); err != nil || len(got) != 0 {
+		t.Fatalf("expected a journal with a torn header to read empty, got %q, %v", got, err)
+	}
+	if _, err := readTestFile(fs, table); err == nil {
+		t.Fatal("expected an error reading a table with a torn header")
+	}
+}
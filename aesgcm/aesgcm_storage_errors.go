@@ -0,0 +1,100 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_errors.go: Errors returned when an encrypted file can't be read
+ *
+ */
+
+package aesgcm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// Errors describing why an encrypted file couldn't be read. Open returns them wrapped in a
+// *storage.ErrCorrupted naming the file, which is what makes goleveldb treat them as corruption, so that
+// leveldb.Recover and the ErrorIfCorrupted options engage. storage.ErrCorrupted has no Unwrap method, so
+// use Cause before errors.Is and errors.As:
+//
+//	if errors.Is(aesgcm.Cause(err), aesgcm.ErrWrongKey) { ... }
+var (
+	// ErrAuthFailed means a file, or part of it, failed authentication: it was modified, or written with
+	// another key. Every *AuthError matches it, ErrWrongKey included.
+	ErrAuthFailed = errors.New("leveldb/aesgcm: message authentication failed")
+
+	// ErrWrongKey means a file's header failed authentication. The header is the same for every file but
+	// for its number and type, so this almost always means the storage was opened with the wrong key.
+	ErrWrongKey = errors.New("leveldb/aesgcm: wrong key")
+
+	// ErrChecksum means a file's checksums show it was damaged on disk, before it was even decrypted. A
+	// damaged file fails authentication too, so every *AuthError with it also matches ErrAuthFailed.
+	ErrChecksum = errors.New("leveldb/aesgcm: checksum mismatch")
+
+	// ErrWriteVerify means a writer with Options.VerifyWrites read back something other than what it
+	// sealed. The Sync or Close that found it fails, as does everything after it on the same writer.
+	ErrWriteVerify = errors.New("leveldb/aesgcm: written data failed verification")
+
+	// ErrUnsupportedVersion means a file was written in a format version this package can't read.
+	ErrUnsupportedVersion = errors.New("leveldb/aesgcm: unsupported format version")
+
+	// ErrTruncated means a file ends before its final chunk, or before its header, nonce or tag is complete.
+	ErrTruncated = errors.New("leveldb/aesgcm: file is truncated")
+)
+
+// AuthError is an authentication failure of a file, or of one of its chunks
+type AuthError struct {
+	Fd storage.FileDesc
+	// Index of the chunk that failed, or -1 for the header and for files written before chunking
+	Chunk int64
+	// ErrWrongKey, ErrChecksum or ErrAuthFailed
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	if e.Chunk < 0 {
+		return fmt.Sprintf("%v: %s", e.Err, e.Fd)
+	}
+	return fmt.Sprintf("%v: %s chunk %d", e.Err, e.Fd, e.Chunk)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes every AuthError match ErrAuthFailed
+func (e *AuthError) Is(target error) bool {
+	return target == ErrAuthFailed
+}
+
+// Cause returns the error wrapped by a *storage.ErrCorrupted, or err itself when it isn't one
+func Cause(err error) error {
+	var cerr *storage.ErrCorrupted
+	if errors.As(err, &cerr) && cerr.Err != nil {
+		return cerr.Err
+	}
+	return err
+}
+
+// corrupted wraps an error of the format into the storage.ErrCorrupted goleveldb expects
+func corrupted(fd storage.FileDesc, err error) error {
+	return &storage.ErrCorrupted{Fd: fd, Err: err}
+}
@@ -0,0 +1,152 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_errors_test.go: Errors returned when an encrypted file can't be read
+ *
+ */
+
+package aesgcm
+
+import (
+	"errors"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestErrors_Taxonomy(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	data := make([]byte, 3*defaultChunkSize)
+	rand.Read(data)
+	writeTestFile(t, fs, fd, data)
+	name := filepath.Join(temp, fsGenName(fd))
+	orig, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := headerLen(formatVersion)
+	chunk := chunkOverhead(formatVersion) + defaultChunkSize
+
+	tests := []struct {
+		name   string
+		tamper func(b []byte) []byte
+		want   error
+	}{
+		{"version", func(b []byte) []byte {
+			b[len(formatMagic)] = formatVersion + 1
+			return b
+		}, ErrUnsupportedVersion},
+		{"header", func(b []byte) []byte {
+			b[hdr-checksumLen-1] ^= 1
+			return b
+		}, ErrChecksum},
+		{"header tag", func(b []byte) []byte {
+			b[hdr-checksumLen-1] ^= 1
+			putChecksum(b[:hdr])
+			return b
+		}, ErrWrongKey},
+		{"chunk", func(b []byte) []byte {
+			b[hdr+chunk+100] ^= 1
+			return b
+		}, ErrChecksum},
+		{"chunk tag", func(b []byte) []byte {
+			b[hdr+chunk+100] ^= 1
+			putChecksum(b[hdr+chunk : hdr+2*chunk])
+			return b
+		}, ErrAuthFailed},
+		{"truncated", func(b []byte) []byte {
+			return b[:len(b)-10]
+		}, ErrTruncated},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(name, tt.tamper(append([]byte(nil), orig...)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readTestFile(fs, fd)
+		if !lerrors.IsCorrupted(err) {
+			t.Fatalf("%s: expected goleveldb to see corruption, got %v", tt.name, err)
+		}
+		var cerr *storage.ErrCorrupted
+		if !errors.As(err, &cerr) || cerr.Fd != fd {
+			t.Fatalf("%s: expected the corrupted file to be named, got %v", tt.name, err)
+		}
+		if !errors.Is(Cause(err), tt.want) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	// Chunk failures tell which chunk failed
+	b := append([]byte(nil), orig...)
+	b[hdr+chunk+100] ^= 1
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readTestFile(fs, fd)
+	var aerr *AuthError
+	if !errors.As(Cause(err), &aerr) || aerr.Fd != fd || aerr.Chunk != 1 || errors.Is(aerr, ErrWrongKey) {
+		t.Fatalf("expected an authentication failure of chunk 1, got %v", err)
+	}
+
+	// I/O errors are left alone
+	_, err = fs.Open(storage.FileDesc{Type: storage.TypeTable, Num: 2})
+	if lerrors.IsCorrupted(err) || !os.IsNotExist(err) {
+		t.Fatalf("expected a missing file error, got %v", err)
+	}
+}
+
+func TestErrors_WrongKey(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	fd := storage.FileDesc{Type: storage.TypeJournal, Num: 1}
+	writeTestFile(t, fs, fd, []byte("record"))
+	fs.Close()
+
+	otherKey := append([]byte(nil), testKey...)
+	otherKey[0] ^= 1
+	fs, err = OpenEncryptedFile(temp, otherKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+	_, err = readTestFile(fs, fd)
+	if !errors.Is(Cause(err), ErrWrongKey) || !errors.Is(Cause(err), ErrAuthFailed) {
+		t.Fatalf("expected a wrong key error, got %v", err)
+	}
+	if n := fs.Metrics().Snapshot().AuthFailures; n != 1 {
+		t.Fatalf("expected 1 authentication failure, got %d", n)
+	}
+}
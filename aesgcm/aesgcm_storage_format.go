@@ -0,0 +1,382 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_format.go: On disk format of encrypted files
+ *
+ * Files are a header followed by independently sealed chunks, so that large files can be sealed and
+ * opened on several cores:
+ *
+ *     header: magic [8] | version [1] | chunk size [4] | nonce [12] | tag [16] | checksum [4]
+ *     chunk:  flags [1] | sealed length [4] | nonce [12] | sealed chunk [sealed length] | checksum [4]
+ *
+ * Integers are little endian. The header tag seals an empty plaintext with the file's additional data
+ * followed by the version and chunk size, so neither can be changed. Each chunk's additional data is the
+ * file's additional data, the chunk's index and its flags, so chunks can't be reordered, moved between
+ * files, or dropped without detection.
+ *
+ * Checksums are the CRC-32C of everything before them in the header or chunk. They need no key, so the
+ * integrity of files on disk can be checked by someone who can't read them, see VerifyChecksums. They only
+ * catch accidental damage; the tags are what protect against tampering. Version 1 files, which lack the
+ * checksums, are still read.
+ *
+ * Files are only ever appended to. Chunks hold at most chunk size bytes of plaintext and are only short
+ * when they end a Sync, marked by chunkCommit, or the file, marked by chunkFinal. Tables are only read once
+ * closed, so they must end with the final chunk, which detects truncation. Journals and manifests are read
+ * back after crashes, so for them everything up to the last commit or final chunk is returned and chunks
+ * after it, never synced and possibly torn, are ignored. That matches goleveldb's own guarantees for them:
+ * only synced writes survive.
+ *
+ * Files written before chunking are a single nonce followed by the whole file sealed at once. Anything
+ * not starting with the magic is read that way.
+ *
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+const (
+	// Version written to new files, and the oldest still read
+	formatVersion   = 2
+	formatVersionV1 = 1
+
+	defaultChunkSize = 64 << 10
+
+	// Largest chunk size accepted when reading a header
+	maxChunkSize = 64 << 20
+
+	headerPrefixLen = 8 + 1 + 4
+	chunkPrefixLen  = 1 + 4
+	checksumLen     = 4
+
+	// AES-GCM as returned by cipher.NewGCM. Fixed, so that files can be parsed without the key.
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+
+	chunkFinal  = 1 << 0
+	chunkCommit = 1 << 1
+)
+
+var formatMagic = []byte("\x89LDBAES\n")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	errBadHeader     = errors.New("leveldb/aesgcm: invalid file header")
+	errBadChunk      = errors.New("leveldb/aesgcm: invalid chunk")
+	errTrailingBytes = errors.New("leveldb/aesgcm: data after the final chunk")
+)
+
+func trailerLen(version byte) int {
+	if version >= 2 {
+		return checksumLen
+	}
+	return 0
+}
+
+func headerLen(version byte) int {
+	return headerPrefixLen + gcmNonceSize + gcmTagSize + trailerLen(version)
+}
+
+// chunkOverhead is the size of a chunk's framing, everything but its plaintext
+func chunkOverhead(version byte) int {
+	return chunkPrefixLen + gcmNonceSize + gcmTagSize + trailerLen(version)
+}
+
+func (fs *aesgcmStorage) newNonce(dst []byte) error {
+	read, err := rand.Read(dst)
+	if err != nil {
+		return err
+	}
+	if read != len(dst) {
+		return errNonceUnavailable
+	}
+	return nil
+}
+
+func chunkAD(fd storage.FileDesc, index uint64, flags byte) []byte {
+	ad := make([]byte, additionalDataLen+8+1)
+	copy(ad, fdGenAD(fd))
+	binary.LittleEndian.PutUint64(ad[additionalDataLen:], index)
+	ad[additionalDataLen+8] = flags
+	return ad
+}
+
+func headerAD(fd storage.FileDesc, prefix []byte) []byte {
+	return append(fdGenAD(fd), prefix[len(formatMagic):]...)
+}
+
+// putChecksum fills the last checksumLen bytes of b with the checksum of the rest
+func putChecksum(b []byte) {
+	n := len(b) - checksumLen
+	binary.LittleEndian.PutUint32(b[n:], crc32.Checksum(b[:n], crcTable))
+}
+
+// checksumOK tells whether the last checksumLen bytes of b are the checksum of the rest
+func checksumOK(b []byte) bool {
+	n := len(b) - checksumLen
+	return binary.LittleEndian.Uint32(b[n:]) == crc32.Checksum(b[:n], crcTable)
+}
+
+// sealHeader returns the header of a new file in a pooled buffer
+func (fs *aesgcmStorage) sealHeader(fd storage.FileDesc, chunkSize int) ([]byte, error) {
+	h := getBuffer(headerLen(formatVersion))
+	copy(h, formatMagic)
+	h[len(formatMagic)] = formatVersion
+	binary.LittleEndian.PutUint32(h[len(formatMagic)+1:], uint32(chunkSize))
+	nonce := h[headerPrefixLen : headerPrefixLen+gcmNonceSize]
+	if err := fs.newNonce(nonce); err != nil {
+		putBuffer(h)
+		return nil, err
+	}
+	fs.cyp.Seal(h[:headerPrefixLen+gcmNonceSize], nonce, nil, headerAD(fd, h[:headerPrefixLen]))
+	putChecksum(h)
+	return h, nil
+}
+
+// parseHeader checks everything of a header that needs no key and returns its chunk size and version.
+// Both are also returned along with ErrChecksum, for salvaging.
+func parseHeader(fd storage.FileDesc, h []byte) (int, byte, error) {
+	if len(h) < headerPrefixLen {
+		return 0, 0, ErrTruncated
+	}
+	if !bytes.Equal(h[:len(formatMagic)], formatMagic) {
+		return 0, 0, errBadHeader
+	}
+	version := h[len(formatMagic)]
+	if version < formatVersionV1 || version > formatVersion {
+		return 0, 0, ErrUnsupportedVersion
+	}
+	if len(h) < headerLen(version) {
+		return 0, 0, ErrTruncated
+	}
+	chunkSize := int(binary.LittleEndian.Uint32(h[len(formatMagic)+1:]))
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		return 0, 0, errBadHeader
+	}
+	if version >= 2 && !checksumOK(h[:headerLen(version)]) {
+		return chunkSize, version, &AuthError{Fd: fd, Chunk: -1, Err: ErrChecksum}
+	}
+	return chunkSize, version, nil
+}
+
+// openHeader checks a file's header and returns its chunk size and version. Like parseHeader, it returns
+// both along with authentication errors.
+func (fs *aesgcmStorage) openHeader(fd storage.FileDesc, h []byte) (int, byte, error) {
+	chunkSize, version, err := parseHeader(fd, h)
+	if err != nil {
+		return chunkSize, version, err
+	}
+	nonce := h[headerPrefixLen : headerPrefixLen+gcmNonceSize]
+	tag := h[headerPrefixLen+gcmNonceSize : headerPrefixLen+gcmNonceSize+gcmTagSize]
+	if _, err := fs.cyp.Open(nil, nonce, tag, headerAD(fd, h[:headerPrefixLen])); err != nil {
+		// The checksum passed, so the bytes are as written, but not with this key
+		return chunkSize, version, &AuthError{Fd: fd, Chunk: -1, Err: ErrWrongKey}
+	}
+	return chunkSize, version, nil
+}
+
+// sealChunk returns a complete chunk, prefix included, in a pooled buffer
+func (fs *aesgcmStorage) sealChunk(fd storage.FileDesc, index uint64, flags byte, plain []byte) ([]byte, error) {
+	c := getBuffer(chunkOverhead(formatVersion) + len(plain))
+	c[0] = flags
+	binary.LittleEndian.PutUint32(c[1:], uint32(len(plain)+gcmTagSize))
+	nonce := c[chunkPrefixLen : chunkPrefixLen+gcmNonceSize]
+	if err := fs.newNonce(nonce); err != nil {
+		putBuffer(c)
+		return nil, err
+	}
+	start := time.Now()
+	fs.cyp.Seal(c[:chunkPrefixLen+gcmNonceSize], nonce, plain, chunkAD(fd, index, flags))
+	fs.metrics.sealed(fd.Type, len(plain), time.Since(start))
+	putChecksum(c)
+	return c, nil
+}
+
+// chunkRef locates a chunk inside a file and its plaintext inside the decrypted file
+type chunkRef struct {
+	index    uint64
+	flags    byte
+	off      int // of the chunk's prefix
+	sealed   int
+	plainOff int
+}
+
+// Where a chunk's parts are within the file
+func (r *chunkRef) nonce() int { return r.off + chunkPrefixLen }
+func (r *chunkRef) body() int  { return r.off + chunkPrefixLen + gcmNonceSize }
+func (r *chunkRef) end(version byte) int {
+	return r.body() + r.sealed + trailerLen(version)
+}
+
+// parseChunk reads the prefix of the chunk at off, checking it fits the file, without a key. Returns
+// ErrTruncated for a chunk cut short and errBadChunk for an impossible length.
+func parseChunk(crypt []byte, off, chunkSize int, version byte) (chunkRef, error) {
+	if len(crypt)-off < chunkOverhead(version) {
+		return chunkRef{}, ErrTruncated
+	}
+	ref := chunkRef{
+		flags:  crypt[off],
+		off:    off,
+		sealed: int(binary.LittleEndian.Uint32(crypt[off+1:])),
+	}
+	if ref.sealed < gcmTagSize || ref.sealed > chunkSize+gcmTagSize {
+		return chunkRef{}, errBadChunk
+	}
+	if ref.end(version) > len(crypt) {
+		return chunkRef{}, ErrTruncated
+	}
+	return ref, nil
+}
+
+// isTornTail tells whether a parseChunk error is the chunk being appended when the writer crashed: one
+// that runs past the end of the file. By then every chunk before it was parsed and none was final, so it
+// also comes after the last commit point. Any other damage, such as an impossible length, is corruption
+// wherever it is in the file.
+func isTornTail(err error) bool {
+	return err == ErrTruncated
+}
+
+// Whether a file type must end with the final chunk, rather than the last commit point
+func requiresFinal(fd storage.FileDesc) bool {
+	return fd.Type == storage.TypeTable || fd.Type == storage.TypeTemp
+}
+
+// scanChunks walks the chunk prefixes following the header, checking they are consistent, and returns
+// where every chunk up to the last commit point is, together with the total plaintext length of those
+func scanChunks(fd storage.FileDesc, crypt []byte, chunkSize int, version byte) ([]chunkRef, int, error) {
+	var (
+		refs       []chunkRef
+		plain      int
+		final      bool
+		committed  int // chunks up to the last commit point
+		commitSize int
+	)
+	strict := requiresFinal(fd)
+	off := headerLen(version)
+	for off < len(crypt) {
+		if final {
+			return nil, 0, errTrailingBytes
+		}
+		ref, err := parseChunk(crypt, off, chunkSize, version)
+		if err != nil {
+			if strict || !isTornTail(err) {
+				return nil, 0, err
+			}
+			break
+		}
+		ref.index = uint64(len(refs))
+		ref.plainOff = plain
+		refs = append(refs, ref)
+		plain += ref.sealed - gcmTagSize
+		off = ref.end(version)
+		final = ref.flags&chunkFinal != 0
+		if ref.flags&(chunkFinal|chunkCommit) != 0 {
+			committed, commitSize = len(refs), plain
+		}
+	}
+	if !final && strict {
+		return nil, 0, ErrTruncated
+	}
+	return refs[:committed], commitSize, nil
+}
+
+// openChunk checks the checksum of a chunk, if it has one, then authenticates and decrypts it into dst
+func (fs *aesgcmStorage) openChunk(fd storage.FileDesc, crypt []byte, ref *chunkRef, version byte, dst []byte) error {
+	if version >= 2 && !checksumOK(crypt[ref.off:ref.end(version)]) {
+		return &AuthError{Fd: fd, Chunk: int64(ref.index), Err: ErrChecksum}
+	}
+	start := time.Now()
+	nonce := crypt[ref.nonce():ref.body()]
+	if _, err := fs.cyp.Open(dst[:0], nonce, crypt[ref.body():ref.body()+ref.sealed], chunkAD(fd, ref.index, ref.flags)); err != nil {
+		return &AuthError{Fd: fd, Chunk: int64(ref.index), Err: ErrAuthFailed}
+	}
+	fs.metrics.opened(fd.Type, len(dst), time.Since(start))
+	return nil
+}
+
+// openChunks authenticates and decrypts a whole chunked file into a pooled buffer, using the storage's
+// worker pool for files of more than one chunk
+func (fs *aesgcmStorage) openChunks(fd storage.FileDesc, crypt []byte) ([]byte, error) {
+	chunkSize, version, err := fs.openHeader(fd, crypt)
+	if err != nil {
+		return nil, err
+	}
+	refs, size, err := scanChunks(fd, crypt, chunkSize, version)
+	if err != nil {
+		return nil, err
+	}
+	plain := getBuffer(size)
+	err = runPipeline(fs.concurrency, len(refs), func(i int) ([]byte, error) {
+		ref := &refs[i]
+		return nil, fs.openChunk(fd, crypt, ref, version, plain[ref.plainOff:ref.plainOff+ref.sealed-gcmTagSize])
+	}, func(i int, b []byte) error {
+		return nil
+	})
+	if err != nil {
+		putBuffer(plain)
+		return nil, err
+	}
+	return plain, nil
+}
+
+// openLegacy decrypts a file written before chunking into a pooled buffer
+func (fs *aesgcmStorage) openLegacy(fd storage.FileDesc, crypt []byte) ([]byte, error) {
+	if len(crypt) < fs.cyp.NonceSize()+fs.cyp.Overhead() {
+		return nil, ErrTruncated
+	}
+	nonce := crypt[:fs.cyp.NonceSize()]
+	plain := getBuffer(len(crypt) - fs.cyp.NonceSize() - fs.cyp.Overhead())
+	start := time.Now()
+	if _, err := fs.cyp.Open(plain[:0], nonce, crypt[fs.cyp.NonceSize():], fdGenAD(fd)); err != nil {
+		putBuffer(plain)
+		return nil, &AuthError{Fd: fd, Chunk: -1, Err: ErrAuthFailed}
+	}
+	fs.metrics.opened(fd.Type, len(plain), time.Since(start))
+	return plain, nil
+}
+
+// isTornHeader tells whether crypt is the start of a header cut short, empty included
+func isTornHeader(crypt []byte) bool {
+	n := len(crypt)
+	if n > len(formatMagic) {
+		n = len(formatMagic)
+	}
+	if !bytes.Equal(crypt[:n], formatMagic[:n]) {
+		return false
+	}
+	if len(crypt) <= len(formatMagic) {
+		return true
+	}
+	version := crypt[len(formatMagic)]
+	return version >= formatVersionV1 && version <= formatVersion && len(crypt) < headerLen(version)
+}
+
+func isChunked(crypt []byte) bool {
+	return len(crypt) >= len(formatMagic) && bytes.Equal(crypt[:len(formatMagic)], formatMagic)
+}
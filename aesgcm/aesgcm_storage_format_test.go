@@ -0,0 +1,196 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_format_test.go: Chunked file format, legacy files and the worker pipeline
+ *
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readTestFile(fs storage.Storage, fd storage.FileDesc) ([]byte, error) {
+	r, err := fs.Open(fd)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestFormat_RoundTrip(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{Concurrency: 4})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	for i, size := range []int{0, 1, defaultChunkSize - 1, defaultChunkSize, defaultChunkSize + 1, 5*defaultChunkSize + 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+		fd := storage.FileDesc{Type: storage.TypeTable, Num: int64(i)}
+		writeTestFile(t, fs, fd, data)
+		got, err := readTestFile(fs, fd)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: contents differ", size)
+		}
+	}
+}
+
+func TestFormat_Legacy(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	// Written the way files were before chunking
+	block, _ := aes.NewCipher(testKey)
+	gcm, _ := cipher.NewGCM(block)
+	fd := storage.FileDesc{Type: storage.TypeJournal, Num: 3}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	data := []byte("written by an older version")
+	legacy := gcm.Seal(append([]byte(nil), nonce...), nonce, data, fdGenAD(fd))
+	if err := ioutil.WriteFile(filepath.Join(temp, fsGenName(fd)), legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readTestFile(fs, fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+}
+
+func TestFormat_Tampering(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	data := make([]byte, 3*defaultChunkSize)
+	rand.Read(data)
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	writeTestFile(t, fs, fd, data)
+	name := filepath.Join(temp, fsGenName(fd))
+	orig, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := headerLen(formatVersion)
+	chunk := chunkOverhead(formatVersion) + defaultChunkSize
+	tamper := map[string]func([]byte) []byte{
+		"truncated": func(b []byte) []byte {
+			return b[:hdr+2*chunk]
+		},
+		"swapped": func(b []byte) []byte {
+			c := append([]byte(nil), b...)
+			copy(c[hdr:], b[hdr+chunk:hdr+2*chunk])
+			copy(c[hdr+chunk:], b[hdr:hdr+chunk])
+			return c
+		},
+		"chunk size": func(b []byte) []byte {
+			c := append([]byte(nil), b...)
+			c[len(formatMagic)+1]++
+			return c
+		},
+		"flipped bit": func(b []byte) []byte {
+			c := append([]byte(nil), b...)
+			c[hdr+chunk+100] ^= 1
+			return c
+		},
+		"appended": func(b []byte) []byte {
+			return append(append([]byte(nil), b...), 0)
+		},
+	}
+	for name2, f := range tamper {
+		if err := ioutil.WriteFile(name, f(orig), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readTestFile(fs, fd); err == nil {
+			t.Errorf("%s: expected an error", name2)
+		}
+	}
+}
+
+func TestPipeline_Order(t *testing.T) {
+	for _, workers := range []int{1, 3, 8} {
+		var got []int
+		err := runPipeline(workers, 100, func(i int) ([]byte, error) {
+			return []byte{byte(i)}, nil
+		}, func(i int, b []byte) error {
+			if int(b[0]) != i {
+				t.Fatalf("result %d delivered as %d", b[0], i)
+			}
+			got = append(got, i)
+			return nil
+		})
+		if err != nil || len(got) != 100 {
+			t.Fatalf("workers %d: got %d results, err %v", workers, len(got), err)
+		}
+	}
+}
+
+func TestPipeline_Error(t *testing.T) {
+	errTest := errors.New("test")
+	for _, workers := range []int{1, 4} {
+		emitted := 0
+		err := runPipeline(workers, 100, func(i int) ([]byte, error) {
+			if i == 10 {
+				return nil, errTest
+			}
+			return getBuffer(10), nil
+		}, func(i int, b []byte) error {
+			emitted++
+			putBuffer(b)
+			return nil
+		})
+		if err != errTest || emitted != 10 {
+			t.Fatalf("workers %d: expected the error after 10 results, got %v after %d", workers, err, emitted)
+		}
+	}
+}
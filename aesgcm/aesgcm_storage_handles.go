@@ -0,0 +1,156 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_handles.go: Registry of the open readers and writers of a storage
+ *
+ */
+
+package aesgcm
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+var (
+	// ErrDoubleClose is returned, wrapped in a *HandleError, by the Close of a reader or writer that was
+	// already closed. It also matches storage.ErrClosed, which goleveldb's storages return instead.
+	ErrDoubleClose = errors.New("leveldb/aesgcm: closed twice")
+
+	// ErrLeakedHandles is returned, as a *LeakError, by the Close of a storage with readers or writers
+	// still open.
+	ErrLeakedHandles = errors.New("leveldb/aesgcm: readers or writers still open")
+)
+
+// Handle describes an open reader or writer of the storage
+type Handle struct {
+	// Unique within the storage, in order of opening
+	ID     uint64
+	Fd     storage.FileDesc
+	Writer bool
+	Opened time.Time
+	// Stack of the goroutine that opened it, only recorded with Options.Debug
+	Stack string
+}
+
+func (h *Handle) String() string {
+	kind := "reader"
+	if h.Writer {
+		kind = "writer"
+	}
+	return fmt.Sprintf("%s #%d of %s opened at %s", kind, h.ID, h.Fd, h.Opened.Format(time.RFC3339Nano))
+}
+
+// HandleError is a misuse of a reader or writer
+type HandleError struct {
+	Handle Handle
+	Err    error
+}
+
+func (e *HandleError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, &e.Handle)
+}
+
+func (e *HandleError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes double closes match storage.ErrClosed
+func (e *HandleError) Is(target error) bool {
+	return target == storage.ErrClosed && e.Err == ErrDoubleClose
+}
+
+// LeakError lists the readers and writers still open when the storage was closed
+type LeakError struct {
+	Handles []Handle
+}
+
+func (e *LeakError) Error() string {
+	s := make([]string, len(e.Handles))
+	for i := range e.Handles {
+		s[i] = e.Handles[i].String()
+	}
+	return fmt.Sprintf("%v: %s", ErrLeakedHandles, strings.Join(s, ", "))
+}
+
+func (e *LeakError) Is(target error) bool {
+	return target == ErrLeakedHandles
+}
+
+// handleRegistry keeps the handles of the open readers and writers
+type handleRegistry struct {
+	debug bool
+
+	mu   sync.Mutex
+	next uint64
+	live map[uint64]*Handle
+}
+
+func newHandleRegistry(debug bool) *handleRegistry {
+	return &handleRegistry{debug: debug, live: make(map[uint64]*Handle)}
+}
+
+func (hr *handleRegistry) add(fd storage.FileDesc, writer bool) *Handle {
+	h := &Handle{Fd: fd, Writer: writer, Opened: time.Now()}
+	if hr.debug {
+		h.Stack = string(debug.Stack())
+	}
+	hr.mu.Lock()
+	hr.next++
+	h.ID = hr.next
+	hr.live[h.ID] = h
+	hr.mu.Unlock()
+	return h
+}
+
+func (hr *handleRegistry) remove(h *Handle) {
+	hr.mu.Lock()
+	delete(hr.live, h.ID)
+	hr.mu.Unlock()
+}
+
+func (hr *handleRegistry) list() []Handle {
+	hr.mu.Lock()
+	handles := make([]Handle, 0, len(hr.live))
+	for _, h := range hr.live {
+		handles = append(handles, *h)
+	}
+	hr.mu.Unlock()
+	sort.Slice(handles, func(i, j int) bool { return handles[i].ID < handles[j].ID })
+	return handles
+}
+
+// OpenHandles returns the readers and writers currently open, oldest first
+func (fs *aesgcmStorage) OpenHandles() []Handle {
+	return fs.handles.list()
+}
+
+// doubleClose reports and returns the error of closing h again
+func (fs *aesgcmStorage) doubleClose(h *Handle) error {
+	err := &HandleError{Handle: *h, Err: ErrDoubleClose}
+	fs.Log(err.Error())
+	return err
+}
@@ -0,0 +1,109 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_handles_test.go: Registry of the open readers and writers of a storage
+ *
+ */
+
+package aesgcm
+
+import (
+	"errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHandles_Registry(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{Debug: true})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+
+	table := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	writeTestFile(t, fs, table, []byte("data"))
+	r, err := fs.Open(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := storage.FileDesc{Type: storage.TypeJournal, Num: 2}
+	w, err := fs.Create(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handles := fs.OpenHandles()
+	if len(handles) != 2 || handles[0].Fd != table || handles[0].Writer || handles[1].Fd != journal || !handles[1].Writer {
+		t.Fatalf("expected the reader then the writer, got %+v", handles)
+	}
+	if !strings.Contains(handles[1].Stack, "TestHandles_Registry") {
+		t.Fatalf("expected the opening stack to be recorded, got %q", handles[1].Stack)
+	}
+
+	// Double closes are reported, and only release the file once
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = r.Close()
+	var herr *HandleError
+	if !errors.Is(err, ErrDoubleClose) || !errors.Is(err, storage.ErrClosed) || !errors.As(err, &herr) || herr.Handle.Fd != table {
+		t.Fatalf("expected a double close of the reader, got %v", err)
+	}
+	if len(fs.OpenHandles()) != 1 {
+		t.Fatalf("expected only the writer to be left, got %+v", fs.OpenHandles())
+	}
+
+	// The writer is leaked
+	err = fs.Close()
+	var lerr *LeakError
+	if !errors.Is(err, ErrLeakedHandles) || !errors.As(err, &lerr) || len(lerr.Handles) != 1 || lerr.Handles[0].Fd != journal {
+		t.Fatalf("expected the writer to be reported leaked, got %v", err)
+	}
+	w.Close()
+}
+
+func TestHandles_NoDebug(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	w, err := fs.Create(storage.FileDesc{Type: storage.TypeTable, Num: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := fs.OpenHandles(); len(h) != 1 || h[0].Stack != "" {
+		t.Fatalf("expected a handle without a stack, got %+v", h)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); !errors.Is(err, ErrDoubleClose) {
+		t.Fatalf("expected a double close of the writer, got %v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("expected a clean close, got %v", err)
+	}
+}
@@ -34,15 +34,15 @@
 package aesgcm
 
 import (
+	"errors"
 	"fmt"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 	"io"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type fileLock interface {
@@ -70,8 +70,8 @@ func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
 func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 func (fs *aesgcmStorage) setMeta(fd storage.FileDesc) error {
-	writeFileSynced := func(filename string, data []byte, perm os.FileMode) error {
-		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	writeFileSynced := func(name string, data []byte, perm os.FileMode) error {
+		f, err := fs.openFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 		if err != nil {
 			return err
 		}
@@ -90,9 +90,8 @@ func (fs *aesgcmStorage) setMeta(fd storage.FileDesc) error {
 
 	content := fsGenName(fd) + "\n"
 	// Check and backup old CURRENT file.
-	currentPath := filepath.Join(fs.path, "CURRENT")
-	if _, err := os.Stat(currentPath); err == nil {
-		b, err := ioutil.ReadFile(currentPath)
+	if _, err := fs.statFile("CURRENT"); err == nil {
+		b, err := fs.readSmallFile("CURRENT", maxCurrentSize)
 		if err != nil {
 			fs.Log(fmt.Sprintf("backup CURRENT: %v", err))
 			return err
@@ -101,38 +100,47 @@ func (fs *aesgcmStorage) setMeta(fd storage.FileDesc) error {
 			// Content not changed, do nothing.
 			return nil
 		}
-		if err := writeFileSynced(currentPath+".bak", b, 0644); err != nil {
+		if err := writeFileSynced("CURRENT.bak", b, fs.fileMode); err != nil {
 			fs.Log(fmt.Sprintf("backup CURRENT: %v", err))
 			return err
 		}
 	} else if !os.IsNotExist(err) {
 		return err
 	}
-	path := fmt.Sprintf("%s.%d", filepath.Join(fs.path, "CURRENT"), fd.Num)
-	if err := writeFileSynced(path, []byte(content), 0644); err != nil {
+	name := fmt.Sprintf("CURRENT.%d", fd.Num)
+	if err := writeFileSynced(name, []byte(content), fs.fileMode); err != nil {
 		fs.Log(fmt.Sprintf("create CURRENT.%d: %v", fd.Num, err))
 		return err
 	}
 	// Replace CURRENT file.
-	if err := rename(path, currentPath); err != nil {
+	if err := fs.dir.rename(name, "CURRENT"); err != nil {
 		fs.Log(fmt.Sprintf("rename CURRENT.%d: %v", fd.Num, err))
 		return err
 	}
 	// Sync root directory.
-	if err := syncDir(fs.path); err != nil {
+	start := time.Now()
+	err := fs.dir.sync()
+	fs.metrics.synced(time.Since(start))
+	if err != nil {
 		fs.Log(fmt.Sprintf("syncDir: %v", err))
 		return err
 	}
 	return nil
 }
 
-func (fs *aesgcmStorage) SetMeta(fd storage.FileDesc) error {
+func (fs *aesgcmStorage) SetMeta(fd storage.FileDesc) (err error) {
+	ev := fs.traceStart(OpSetMeta, fd)
+	defer func() { fs.traceEnd(ev, 0, err) }()
+
 	if !storage.FileDescOk(fd) {
 		return storage.ErrInvalidFile
 	}
 	if fs.readOnly {
 		return errReadOnly
 	}
+	if err := fs.commitWriter(fd); err != nil {
+		return err
+	}
 
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -142,6 +150,31 @@ func (fs *aesgcmStorage) SetMeta(fd storage.FileDesc) error {
 	return fs.setMeta(fd)
 }
 
+// commitWriter commits the open writer of fd, if any, publishing it if it never was. goleveldb points
+// CURRENT at a new manifest without syncing it, which would leave CURRENT naming a file that only exists
+// under its pending name, and is removed as such on the next open.
+func (fs *aesgcmStorage) commitWriter(fd storage.FileDesc) error {
+	var w *aesgcmWriter
+	fs.mu.Lock()
+	for ow := range fs.writers {
+		if ow.fd == fd {
+			w = ow
+			break
+		}
+	}
+	fs.mu.Unlock()
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || (w.published && !w.dirty && len(w.pending) == 0) {
+		return nil
+	}
+	return w.commit(chunkCommit)
+}
+
 func isCorrupted(err error) bool {
 	switch err.(type) {
 	case *storage.ErrCorrupted:
@@ -150,21 +183,23 @@ func isCorrupted(err error) bool {
 	return false
 }
 
-func (fs *aesgcmStorage) GetMeta() (storage.FileDesc, error) {
+func (fs *aesgcmStorage) GetMeta() (fd storage.FileDesc, err error) {
+	ev := fs.traceStart(OpGetMeta, storage.FileDesc{})
+	fd, err = fs.getMeta()
+	if ev != nil {
+		ev.Fd = fd
+	}
+	fs.traceEnd(ev, 0, err)
+	return
+}
+
+func (fs *aesgcmStorage) getMeta() (storage.FileDesc, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	if fs.open < 0 {
 		return storage.FileDesc{}, storage.ErrClosed
 	}
-	dir, err := os.Open(fs.path)
-	if err != nil {
-		return storage.FileDesc{}, err
-	}
-	names, err := dir.Readdirnames(0)
-	// Close the dir first before checking for Readdirnames error.
-	if ce := dir.Close(); ce != nil {
-		fs.Log(fmt.Sprintf("close dir: %v", ce))
-	}
+	names, err := fs.dir.names()
 	if err != nil {
 		return storage.FileDesc{}, err
 	}
@@ -179,20 +214,23 @@ func (fs *aesgcmStorage) GetMeta() (storage.FileDesc, error) {
 		fd   storage.FileDesc
 	}
 	tryCurrent := func(name string) (*currentFile, error) {
-		b, err := ioutil.ReadFile(filepath.Join(fs.path, name))
+		b, err := fs.readSmallFile(name, maxCurrentSize)
 		if err != nil {
 			if os.IsNotExist(err) {
 				err = os.ErrNotExist
+			} else if errors.Is(err, ErrFileTooLarge) {
+				fs.Log(fmt.Sprintf("%s: %v", name, err))
+				err = &storage.ErrCorrupted{Err: errCorruptedCurrent}
 			}
 			return nil, err
 		}
 		var fd storage.FileDesc
-		if len(b) < 1 || b[len(b)-1] != '\n' || !fsParseNamePtr(string(b[:len(b)-1]), &fd) {
+		if len(b) < 1 || b[len(b)-1] != '\n' || !fsParseNamePtr(string(b[:len(b)-1]), &fd) || fd.Type != storage.TypeManifest {
 			fs.Log(fmt.Sprintf("%s: corrupted content: %q", name, b))
 			err := &storage.ErrCorrupted{Err: errCorruptedCurrent}
 			return nil, err
 		}
-		if _, err := os.Stat(filepath.Join(fs.path, fsGenName(fd))); err != nil {
+		if _, err := fs.statFile(fsGenName(fd)); err != nil {
 			if os.IsNotExist(err) {
 				fs.Log(fmt.Sprintf("%s: missing target file: %s", name, fd))
 				err = os.ErrNotExist
@@ -278,7 +316,7 @@ func (fs *aesgcmStorage) GetMeta() (storage.FileDesc, error) {
 			if err := fs.setMeta(curCur.fd); err == nil {
 				// Remove 'pending rename' files.
 				for _, name := range pendNames {
-					if err := os.Remove(filepath.Join(fs.path, name)); err != nil {
+					if err := fs.dir.remove(name); err != nil {
 						fs.Log(fmt.Sprintf("remove %s: %v", name, err))
 					}
 				}
@@ -300,15 +338,7 @@ func (fs *aesgcmStorage) List(ft storage.FileType) (fds []storage.FileDesc, err
 	if fs.open < 0 {
 		return nil, storage.ErrClosed
 	}
-	dir, err := os.Open(fs.path)
-	if err != nil {
-		return
-	}
-	names, err := dir.Readdirnames(0)
-	// Close the dir first before checking for Readdirnames error.
-	if cerr := dir.Close(); cerr != nil {
-		fs.Log(fmt.Sprintf("close dir: %v", cerr))
-	}
+	names, err := fs.dir.names()
 	if err == nil {
 		for _, name := range names {
 			if fd, ok := fsParseName(name); ok && fd.Type&ft != 0 {
@@ -334,7 +364,42 @@ func fsGenName(fd storage.FileDesc) string {
 	}
 }
 
+// Files are written under a pending name next to their own, and renamed over it once their contents are
+// durable. fsParseName rejects pending names, so they never show up in List.
+const pendingSuffix = ".pending"
+
+func fsGenPendingName(fd storage.FileDesc) string {
+	return fsGenName(fd) + pendingSuffix
+}
+
+// removePending deletes pending files left behind by writers that never published them
+func removePending(dir *dirHandle) error {
+	names, err := dir.names()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, pendingSuffix) {
+			continue
+		}
+		if err := dir.remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsParseName only accepts names exactly as fsGenName writes them, so a name found in the directory can't
+// stand for a file of another name
 func fsParseName(name string) (fd storage.FileDesc, ok bool) {
+	fd, ok = fsParseLooseName(name)
+	if !ok || fd.Num < 0 || fsGenName(fd) != name {
+		return storage.FileDesc{}, false
+	}
+	return fd, true
+}
+
+func fsParseLooseName(name string) (fd storage.FileDesc, ok bool) {
 	var tail string
 	_, err := fmt.Sscanf(name, "%d.%s", &fd.Num, &tail)
 	if err == nil {
@@ -382,7 +447,13 @@ func (fs *aesgcmStorage) Lock() (storage.Locker, error) {
 	return fs.slock, nil
 }
 
-func (fs *aesgcmStorage) Remove(fd storage.FileDesc) error {
+func (fs *aesgcmStorage) Remove(fd storage.FileDesc) (err error) {
+	fs.pauseRemove.RLock()
+	defer fs.pauseRemove.RUnlock()
+
+	ev := fs.traceStart(OpRemove, fd)
+	defer func() { fs.traceEnd(ev, 0, err) }()
+
 	if !storage.FileDescOk(fd) {
 		return storage.ErrInvalidFile
 	}
@@ -395,14 +466,29 @@ func (fs *aesgcmStorage) Remove(fd storage.FileDesc) error {
 	if fs.open < 0 {
 		return storage.ErrClosed
 	}
-	err := os.Remove(filepath.Join(fs.path, fsGenName(fd)))
+	// A writer that never published leaves only its pending file
+	perr := fs.dir.remove(fsGenPendingName(fd))
+	err = fs.dir.remove(fsGenName(fd))
+	if os.IsNotExist(err) && perr == nil {
+		err = nil
+	}
 	if err != nil {
 		fs.Log(fmt.Sprintf("remove %s: %v", fd, err))
 	}
 	return err
 }
 
-func (fs *aesgcmStorage) Rename(oldfd, newfd storage.FileDesc) error {
+func (fs *aesgcmStorage) Rename(oldfd, newfd storage.FileDesc) (err error) {
+	fs.pauseRemove.RLock()
+	defer fs.pauseRemove.RUnlock()
+
+	ev := fs.traceStart(OpRename, oldfd)
+	if ev != nil {
+		ev.NewFd = newfd
+	}
+	var n int
+	defer func() { fs.traceEnd(ev, int64(n), err) }()
+
 	if !storage.FileDescOk(oldfd) || !storage.FileDescOk(newfd) {
 		return storage.ErrInvalidFile
 	}
@@ -413,10 +499,54 @@ func (fs *aesgcmStorage) Rename(oldfd, newfd storage.FileDesc) error {
 		return errReadOnly
 	}
 
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-	if fs.open < 0 {
-		return storage.ErrClosed
+	if err := fs.acquire(); err != nil {
+		return err
+	}
+	defer fs.release()
+	n, err = fs.reseal(oldfd, newfd)
+	return err
+}
+
+// reseal moves a file to a new name. Every chunk is bound to the file's type and number, so a plain rename
+// would make the file unreadable: the contents are decrypted and sealed again under the new name instead,
+// then the old file is removed. Returns the number of plaintext bytes moved.
+func (fs *aesgcmStorage) reseal(oldfd, newfd storage.FileDesc) (int, error) {
+	of, err := fs.openFile(fsGenName(oldfd), os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	plain, err := fs.decryptFile(oldfd, of)
+	of.Close()
+	if err != nil {
+		return 0, err
+	}
+	defer putBuffer(plain)
+
+	if err := fs.acquire(); err != nil {
+		return 0, err
+	}
+	pending := fsGenPendingName(newfd)
+	nf, err := fs.openFile(pending, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fs.fileMode)
+	if err != nil {
+		fs.release()
+		return 0, err
+	}
+	fs.metrics.writerOpened(1)
+	w := newWriter(nf, newfd, fs)
+	w.internal = true
+	_, err = w.Write(plain)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		w.abort()
+		fs.dir.remove(pending)
+		fs.Log(fmt.Sprintf("rename %s to %s: %v", oldfd, newfd, err))
+		return 0, err
+	}
+	if err := fs.dir.remove(fsGenName(oldfd)); err != nil {
+		fs.Log(fmt.Sprintf("rename %s to %s: remove: %v", oldfd, newfd, err))
+		return len(plain), err
 	}
-	return rename(filepath.Join(fs.path, fsGenName(oldfd)), filepath.Join(fs.path, fsGenName(newfd)))
+	return len(plain), nil
 }
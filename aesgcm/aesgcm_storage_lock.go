@@ -0,0 +1,194 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_lock.go: Waiting for the directory lock and recording who holds it
+ *
+ */
+
+package aesgcm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Bounds of the pause between attempts at taking a busy lock
+const (
+	lockPollMin = time.Millisecond
+	lockPollMax = 100 * time.Millisecond
+
+	// Largest LOCK file read for its holder
+	maxLockInfoSize = 4 << 10
+)
+
+// ErrLocked is matched by the *LockError returned when another process holds the database's lock
+var ErrLocked = errors.New("leveldb/aesgcm: database is locked by another process")
+
+// LockHolder is what a writable storage records in the LOCK file of its directory while it holds the lock
+type LockHolder struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// HolderState tells whether the process named by a LockHolder still runs
+type HolderState int
+
+const (
+	// HolderUnknown is the state of holders on other hosts, when the LOCK file named no holder, or on
+	// platforms that can't tell whether a process runs
+	HolderUnknown HolderState = iota
+	HolderRunning
+	// HolderGone means no process with the holder's PID runs on this host anymore, so the record is stale
+	// and someone else holds the lock. Locks are released when their process exits, and writable storages
+	// empty the record when they close, so the record was left by a writable storage that crashed, and the
+	// lock is held by a read-only storage, which takes it without recording itself. Secondary storages
+	// never take the lock.
+	HolderGone
+)
+
+var holderStateNames = []string{"unknown", "running", "gone"}
+
+func (s HolderState) String() string {
+	if s >= 0 && int(s) < len(holderStateNames) {
+		return holderStateNames[s]
+	}
+	return fmt.Sprintf("HolderState(%d)", int(s))
+}
+
+// LockError is returned when the database's lock is held by another process, either at once or once the
+// context given to OpenEncryptedFileContext is done. It matches ErrLocked.
+type LockError struct {
+	Path string
+	// Last writable storage to hold the lock, as recorded in the LOCK file, or nil. While a read-only
+	// storage holds the lock, this is nil or a stale record, see HolderGone.
+	Holder *LockHolder
+	State  HolderState
+	// The error of the last attempt, or the context's error
+	Err error
+}
+
+func (e *LockError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("%v: %s: %v", ErrLocked, e.Path, e.Err)
+	}
+	return fmt.Sprintf("%v: %s: held by pid %d on %s since %s (%s): %v", ErrLocked, e.Path, e.Holder.PID,
+		e.Holder.Host, e.Holder.Started.Format(time.RFC3339), e.State, e.Err)
+}
+
+func (e *LockError) Unwrap() error {
+	return e.Err
+}
+
+func (e *LockError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// acquireFileLock takes the lock at path, retrying while another process holds it until ctx is done. A nil
+// ctx means a single attempt.
+func acquireFileLock(ctx context.Context, path string, perm os.FileMode, readOnly bool) (fileLock, error) {
+	delay := lockPollMin
+	for {
+		fl, err := newFileLock(path, perm, readOnly)
+		if err == nil {
+			return fl, nil
+		}
+		if !isLockBusy(err) {
+			return nil, err
+		}
+		if ctx == nil {
+			return nil, newLockError(path, err)
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, newLockError(path, ctx.Err())
+		case <-t.C:
+		}
+		if delay *= 2; delay > lockPollMax {
+			delay = lockPollMax
+		}
+	}
+}
+
+// nopFileLock stands in for the lock of a secondary storage, which never takes it
+type nopFileLock struct{}
+
+func (nopFileLock) release() error {
+	return nil
+}
+
+func newLockError(path string, err error) *LockError {
+	e := &LockError{Path: path, Err: err}
+	if e.Holder = readLockHolder(path); e.Holder != nil {
+		e.State = e.Holder.state()
+	}
+	return e
+}
+
+func (h *LockHolder) state() HolderState {
+	if host, err := os.Hostname(); err != nil || host != h.Host || h.PID <= 0 {
+		return HolderUnknown
+	}
+	running, known := processRunning(h.PID)
+	switch {
+	case !known:
+		return HolderUnknown
+	case running:
+		return HolderRunning
+	}
+	return HolderGone
+}
+
+// writeLockHolder records this process in the LOCK file f, just locked for writing. It only serves error
+// messages, so failures are ignored. The file is emptied again when the lock is released, so that it never
+// names a process that's gone.
+func writeLockHolder(f *os.File) {
+	host, _ := os.Hostname()
+	b, err := json.Marshal(&LockHolder{PID: os.Getpid(), Host: host, Started: time.Now()})
+	if err != nil {
+		return
+	}
+	if f.Truncate(0) == nil {
+		f.WriteAt(append(b, '\n'), 0)
+	}
+}
+
+func readLockHolder(path string) *LockHolder {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, maxLockInfoSize))
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	var h LockHolder
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil
+	}
+	return &h
+}
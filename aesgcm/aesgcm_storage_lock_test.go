@@ -0,0 +1,113 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_lock_test.go: Waiting for the directory lock and recording who holds it
+ *
+ */
+
+package aesgcm
+
+import (
+	"context"
+	"errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLock_Holder(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+
+	_, err = OpenEncryptedFile(temp, testKey, false)
+	var lerr *LockError
+	if !errors.Is(err, ErrLocked) || !errors.As(err, &lerr) {
+		t.Fatalf("expected the second open to fail at once, got %v", err)
+	}
+	if lerr.Holder == nil || lerr.Holder.PID != os.Getpid() || lerr.State != HolderRunning {
+		t.Fatalf("expected this process to be named as the running holder, got %+v", lerr)
+	}
+
+	fs.Close()
+	if b, err := ioutil.ReadFile(filepath.Join(temp, "LOCK")); err != nil || len(b) != 0 {
+		t.Fatalf("expected the LOCK file to be emptied on close, got %q and %v", b, err)
+	}
+}
+
+func TestLock_Wait(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := OpenEncryptedFileContext(ctx, temp, testKey, nil); !errors.Is(err, ErrLocked) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to give up at the deadline, got %v", err)
+	}
+
+	// Waits for the holder to close
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		fs.Close()
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fs2, err := OpenEncryptedFileContext(ctx, temp, testKey, nil)
+	if err != nil {
+		t.Fatalf("expected the lock to be taken once released, got %v", err)
+	}
+	fs2.Close()
+}
+
+func TestLock_Secondary(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	sfs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{Secondary: true})
+	if err != nil {
+		t.Fatalf("expected a secondary to open without the lock, got %v", err)
+	}
+	if _, err := sfs.Create(storage.FileDesc{Type: storage.TypeTable, Num: 1}); err == nil {
+		t.Fatal("expected a secondary to be read-only")
+	}
+	sfs.Close()
+
+	// Still held by the writer
+	if _, err := OpenEncryptedFile(temp, testKey, true); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected the writer to keep the lock, got %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_metrics.go: Counters and latency histograms for the encrypted storage
+ *
+ */
+
+package aesgcm
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// Index of each file type in the per type counters
+const (
+	ftManifest = iota
+	ftJournal
+	ftTable
+	ftTemp
+	numFileTypes
+)
+
+var fileTypeNames = [numFileTypes]string{"manifest", "journal", "table", "temp"}
+
+func fileTypeIndex(ft storage.FileType) int {
+	switch ft {
+	case storage.TypeManifest:
+		return ftManifest
+	case storage.TypeJournal:
+		return ftJournal
+	case storage.TypeTable:
+		return ftTable
+	default:
+		return ftTemp
+	}
+}
+
+// Upper bounds of the latency histogram buckets, growing by a factor of 4 from 1µs to ~4s.
+// Anything slower ends up in the implicit +Inf bucket.
+var histogramBounds = func() []time.Duration {
+	b := make([]time.Duration, 12)
+	d := time.Microsecond
+	for i := range b {
+		b[i] = d
+		d *= 4
+	}
+	return b
+}()
+
+type histogram struct {
+	count   int64
+	sum     int64
+	buckets [13]int64 // len(histogramBounds) + 1 for +Inf
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddInt64(&h.count, 1)
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Count:   atomic.LoadInt64(&h.count),
+		Sum:     time.Duration(atomic.LoadInt64(&h.sum)),
+		Buckets: make([]HistogramBucket, len(h.buckets)),
+	}
+	for i := range h.buckets {
+		s.Buckets[i].Count = atomic.LoadInt64(&h.buckets[i])
+		if i < len(histogramBounds) {
+			s.Buckets[i].UpperBound = histogramBounds[i]
+		} else {
+			s.Buckets[i].UpperBound = -1
+		}
+	}
+	return s
+}
+
+// HistogramBucket is the number of observations in a single latency bucket. Buckets are not cumulative.
+type HistogramBucket struct {
+	// Upper bound of the bucket (inclusive), or -1 for the +Inf bucket
+	UpperBound time.Duration
+	Count      int64
+}
+
+// HistogramSnapshot is a point in time copy of a latency histogram
+type HistogramSnapshot struct {
+	Count   int64
+	Sum     time.Duration
+	Buckets []HistogramBucket
+}
+
+// MetricsSnapshot is a point in time copy of the counters kept by Metrics.
+// The per type maps are keyed by "manifest", "journal", "table" and "temp".
+type MetricsSnapshot struct {
+	SealedBytes  map[string]int64
+	OpenedBytes  map[string]int64
+	SealLatency  HistogramSnapshot
+	OpenLatency  HistogramSnapshot
+	SyncLatency  HistogramSnapshot
+	AuthFailures int64
+	OpenReaders  int64
+	OpenWriters  int64
+	// Decrypted bytes currently held by readers, and how often a reader's plaintext was evicted
+	PlaintextBytes int64
+	Evictions      int64
+	// Files checked by Verify, e.g. from a Scrubber, the ciphertext bytes read, and the files that failed
+	VerifiedFiles  int64
+	VerifiedBytes  int64
+	VerifyFailures int64
+}
+
+// Metrics records what the encryption layer costs: bytes sealed and opened per file type, the latencies
+// of Seal, Open and fsync calls, authentication failures and the number of currently open readers and
+// writers. It is safe for concurrent use.
+type Metrics struct {
+	sealedBytes  [numFileTypes]int64
+	openedBytes  [numFileTypes]int64
+	authFailures int64
+	openReaders  int64
+	openWriters  int64
+	plaintext    int64
+	evictions    int64
+
+	verifiedFiles  int64
+	verifiedBytes  int64
+	verifyFailures int64
+
+	sealLatency histogram
+	openLatency histogram
+	syncLatency histogram
+}
+
+// NewMetrics creates an empty metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) sealed(ft storage.FileType, n int, d time.Duration) {
+	atomic.AddInt64(&m.sealedBytes[fileTypeIndex(ft)], int64(n))
+	m.sealLatency.observe(d)
+}
+
+func (m *Metrics) opened(ft storage.FileType, n int, d time.Duration) {
+	atomic.AddInt64(&m.openedBytes[fileTypeIndex(ft)], int64(n))
+	m.openLatency.observe(d)
+}
+
+func (m *Metrics) synced(d time.Duration) {
+	m.syncLatency.observe(d)
+}
+
+func (m *Metrics) authFailed() {
+	atomic.AddInt64(&m.authFailures, 1)
+}
+
+func (m *Metrics) readerOpened(delta int64) {
+	atomic.AddInt64(&m.openReaders, delta)
+}
+
+func (m *Metrics) writerOpened(delta int64) {
+	atomic.AddInt64(&m.openWriters, delta)
+}
+
+func (m *Metrics) plaintextHeld(delta int64) {
+	atomic.AddInt64(&m.plaintext, delta)
+}
+
+func (m *Metrics) evicted() {
+	atomic.AddInt64(&m.evictions, 1)
+}
+
+func (m *Metrics) verified(n int64, err error) {
+	atomic.AddInt64(&m.verifiedFiles, 1)
+	atomic.AddInt64(&m.verifiedBytes, n)
+	if err != nil {
+		atomic.AddInt64(&m.verifyFailures, 1)
+	}
+}
+
+// Snapshot returns a consistent enough copy of the current values; individual counters are read atomically
+// but not as a group.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	s := MetricsSnapshot{
+		SealedBytes:  make(map[string]int64, numFileTypes),
+		OpenedBytes:  make(map[string]int64, numFileTypes),
+		SealLatency:  m.sealLatency.snapshot(),
+		OpenLatency:  m.openLatency.snapshot(),
+		SyncLatency:  m.syncLatency.snapshot(),
+		AuthFailures: atomic.LoadInt64(&m.authFailures),
+		OpenReaders:  atomic.LoadInt64(&m.openReaders),
+		OpenWriters:  atomic.LoadInt64(&m.openWriters),
+
+		PlaintextBytes: atomic.LoadInt64(&m.plaintext),
+		Evictions:      atomic.LoadInt64(&m.evictions),
+
+		VerifiedFiles:  atomic.LoadInt64(&m.verifiedFiles),
+		VerifiedBytes:  atomic.LoadInt64(&m.verifiedBytes),
+		VerifyFailures: atomic.LoadInt64(&m.verifyFailures),
+	}
+	for i, name := range fileTypeNames {
+		s.SealedBytes[name] = atomic.LoadInt64(&m.sealedBytes[i])
+		s.OpenedBytes[name] = atomic.LoadInt64(&m.openedBytes[i])
+	}
+	return s
+}
+
+// Var returns an expvar.Var rendering the current snapshot as JSON, suitable for expvar.Publish
+func (m *Metrics) Var() expvar.Var {
+	return expvar.Func(func() interface{} {
+		return m.Snapshot()
+	})
+}
+
+// WritePrometheus writes the current snapshot in the Prometheus text exposition format. Every metric name
+// is prefixed with namespace and an underscore, e.g. "leveldb_aesgcm_sealed_bytes_total".
+func (m *Metrics) WritePrometheus(w io.Writer, namespace string) error {
+	s := m.Snapshot()
+	p := &promWriter{w: w, ns: namespace}
+
+	p.header("sealed_bytes_total", "counter", "Plaintext bytes encrypted, by file type.")
+	for _, name := range fileTypeNames {
+		p.sample("sealed_bytes_total", fmt.Sprintf("{type=%q}", name), s.SealedBytes[name])
+	}
+	p.header("opened_bytes_total", "counter", "Plaintext bytes decrypted, by file type.")
+	for _, name := range fileTypeNames {
+		p.sample("opened_bytes_total", fmt.Sprintf("{type=%q}", name), s.OpenedBytes[name])
+	}
+	p.header("auth_failures_total", "counter", "Files which failed GCM authentication.")
+	p.sample("auth_failures_total", "", s.AuthFailures)
+	p.header("open_readers", "gauge", "Currently open readers.")
+	p.sample("open_readers", "", s.OpenReaders)
+	p.header("open_writers", "gauge", "Currently open writers.")
+	p.sample("open_writers", "", s.OpenWriters)
+	p.header("plaintext_bytes", "gauge", "Decrypted bytes held in memory by open readers.")
+	p.sample("plaintext_bytes", "", s.PlaintextBytes)
+	p.header("evictions_total", "counter", "Reader plaintext evicted to stay within the memory budget.")
+	p.sample("evictions_total", "", s.Evictions)
+	p.header("verified_files_total", "counter", "Files checked by the integrity scrubber.")
+	p.sample("verified_files_total", "", s.VerifiedFiles)
+	p.header("verified_bytes_total", "counter", "Ciphertext bytes checked by the integrity scrubber.")
+	p.sample("verified_bytes_total", "", s.VerifiedBytes)
+	p.header("verify_failures_total", "counter", "Files which failed the integrity scrubber's check.")
+	p.sample("verify_failures_total", "", s.VerifyFailures)
+	p.histogram("seal_duration_seconds", "Latency of AES-GCM Seal calls.", s.SealLatency)
+	p.histogram("open_duration_seconds", "Latency of AES-GCM Open calls.", s.OpenLatency)
+	p.histogram("fsync_duration_seconds", "Latency of file and directory fsync calls.", s.SyncLatency)
+	return p.err
+}
+
+type promWriter struct {
+	w   io.Writer
+	ns  string
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *promWriter) header(name, kind, help string) {
+	p.printf("# HELP %s_%s %s\n# TYPE %s_%s %s\n", p.ns, name, help, p.ns, name, kind)
+}
+
+func (p *promWriter) sample(name, labels string, v int64) {
+	p.printf("%s_%s%s %d\n", p.ns, name, labels, v)
+}
+
+func (p *promWriter) histogram(name, help string, h HistogramSnapshot) {
+	p.header(name, "histogram", help)
+	var cum int64
+	for _, b := range h.Buckets {
+		cum += b.Count
+		le := "+Inf"
+		if b.UpperBound >= 0 {
+			le = fmt.Sprintf("%g", b.UpperBound.Seconds())
+		}
+		p.printf("%s_%s_bucket{le=%q} %d\n", p.ns, name, le, cum)
+	}
+	p.printf("%s_%s_sum %g\n", p.ns, name, h.Sum.Seconds())
+	p.printf("%s_%s_count %d\n", p.ns, name, h.Count)
+}
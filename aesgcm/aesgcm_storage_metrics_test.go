@@ -0,0 +1,119 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_metrics_test.go: Metrics recorded by the encrypted storage
+ *
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetrics_Counters(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fs.Metrics().Snapshot(); s.OpenWriters != 1 {
+		t.Fatalf("expected 1 open writer, got %d", s.OpenWriters)
+	}
+	w.Write([]byte("TEST"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.Open(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := fs.Metrics().Snapshot()
+	if s.OpenWriters != 0 || s.OpenReaders != 1 {
+		t.Fatalf("expected 0 writers and 1 reader, got %d and %d", s.OpenWriters, s.OpenReaders)
+	}
+	r.Close()
+
+	s = fs.Metrics().Snapshot()
+	if s.SealedBytes["table"] != 4 || s.OpenedBytes["table"] != 4 {
+		t.Fatalf("expected 4 bytes sealed and opened, got %d and %d", s.SealedBytes["table"], s.OpenedBytes["table"])
+	}
+	if s.SealLatency.Count != 1 || s.OpenLatency.Count != 1 || s.SyncLatency.Count == 0 {
+		t.Fatalf("unexpected latency counts: seal=%d open=%d sync=%d", s.SealLatency.Count, s.OpenLatency.Count, s.SyncLatency.Count)
+	}
+
+	// Flip a bit in the ciphertext
+	name := filepath.Join(temp, fsGenName(fd))
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 1
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open(fd); err == nil {
+		t.Fatal("expected tampered file to fail")
+	}
+	if s := fs.Metrics().Snapshot(); s.AuthFailures != 1 {
+		t.Fatalf("expected 1 auth failure, got %d", s.AuthFailures)
+	}
+}
+
+func TestMetrics_Prometheus(t *testing.T) {
+	m := NewMetrics()
+	m.sealed(storage.TypeJournal, 10, 3000)
+	m.authFailed()
+
+	var buf bytes.Buffer
+	if err := m.WritePrometheus(&buf, "leveldb_aesgcm"); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`leveldb_aesgcm_sealed_bytes_total{type="journal"} 10`,
+		`leveldb_aesgcm_auth_failures_total 1`,
+		`leveldb_aesgcm_seal_duration_seconds_bucket{le="+Inf"} 1`,
+		`leveldb_aesgcm_seal_duration_seconds_count 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+
+	if v := m.Var().String(); !strings.Contains(v, `"AuthFailures":1`) {
+		t.Errorf("unexpected expvar output: %s", v)
+	}
+}
@@ -0,0 +1,334 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_options.go: Optional parameters of the encrypted storage
+ *
+ */
+
+package aesgcm
+
+import (
+	"os"
+	"runtime"
+	"time"
+)
+
+const (
+	defaultWriteBufferSize = 4 << 20
+	defaultSyncInterval    = time.Second
+	defaultFileMode        = 0600
+	defaultDirMode         = 0700
+	defaultMaxFileSize     = 1 << 30
+)
+
+// Options holds the optional parameters of the encrypted storage. Like goleveldb's opt.Options, a nil
+// *Options is valid and every field falls back to its default when left at the zero value.
+type Options struct {
+	// ReadOnly opens the storage in read-only mode, taking a shared lock on the directory.
+	//
+	// The default value is false.
+	ReadOnly bool
+
+	// Secondary opens the storage read-only without taking the directory's lock, alongside the process that
+	// has it open and is writing to it. Files may be replaced or removed by that process at any time, so
+	// this is only meant for goleveldb opened read-only on top, reopened to catch up with the writer.
+	//
+	// The default value is false.
+	Secondary bool
+
+	// Hooks are called around every traced storage call.
+	//
+	// The default value is nil, which disables tracing.
+	Hooks *Hooks
+
+	// MemoryBudget caps the decrypted plaintext, in bytes, held by all open readers together. Readers hold
+	// whole files, and goleveldb keeps many tables open, so without a cap the plaintext of every cached
+	// table stays in memory. When the cap is exceeded the least recently used readers drop their plaintext
+	// and decrypt it again when next read.
+	//
+	// The default value is 0, which means no limit.
+	MemoryBudget int64
+
+	// DisableCoreDumps stops the whole process from writing core dumps while the storage is open, by
+	// lowering the soft RLIMIT_CORE to zero and clearing the dumpable flag. Both are restored once the
+	// last storage asking for it is closed. Only supported on Linux; elsewhere opening fails.
+	//
+	// The default value is false.
+	DisableCoreDumps bool
+
+	// Concurrency is the number of goroutines sealing or opening the chunks of a single large file, e.g.
+	// a compaction output or a table opened during recovery. Chunks are still written in order, and at most
+	// twice this many are held in memory ahead of the writer.
+	//
+	// The default value is GOMAXPROCS. Values below 1 also mean the default.
+	Concurrency int
+
+	// WriteBufferSize is how much plaintext, in bytes, a writer holds before sealing it and writing it out.
+	// It is rounded down to a whole number of chunks, with a minimum of one chunk. Writers never hold the
+	// whole of a large file in memory.
+	//
+	// The default value is 4MiB.
+	WriteBufferSize int
+
+	// Durability trades the cost of a writer's Sync against what survives a crash, see the Durability
+	// constants.
+	//
+	// The default value is DurabilityStandard.
+	Durability Durability
+
+	// SyncInterval is how often journals are fsynced under DurabilityRelaxed. It is ignored by the other
+	// modes.
+	//
+	// The default value is 1 second.
+	SyncInterval time.Duration
+
+	// Quarantine moves files that fail authentication on Open into the quarantine subdirectory, with a
+	// JSON report next to each, instead of leaving them in place. Open still returns the corruption error,
+	// so goleveldb's recovery proceeds without the file, and the quarantined file is kept for inspection,
+	// see Storage.Quarantined. Files are only quarantined once another file has authenticated, and never
+	// for ErrWrongKey, so opening with the wrong key moves nothing. Ignored by read-only storages.
+	//
+	// The default value is false.
+	Quarantine bool
+
+	// VerifyWrites makes writers read back what they wrote, authenticate it and compare it with what was
+	// sealed before a Sync or Close returns, failing it otherwise, so bit flips in memory or on the way to
+	// the disk are caught while goleveldb can still fail the write. The read is usually served from the
+	// operating system's cache, so damage done by the disk itself is left to the Scrubber. Costs a read
+	// and a decryption of everything written.
+	//
+	// The default value is false.
+	VerifyWrites bool
+
+	// CipherSuite selects the cipher, see the CipherSuite constants.
+	//
+	// The default value is CipherAESGCM, which picks the AES key size from the length of the key.
+	CipherSuite CipherSuite
+
+	// KeySource supplies the key in place of the key argument of OpenEncryptedFileWithOptions, which must
+	// then be nil.
+	//
+	// The default value is nil, which means the key argument is used.
+	KeySource KeySource
+
+	// Logger receives the storage's log messages.
+	//
+	// The default value is nil, which discards them.
+	Logger Logger
+
+	// FileMode is the permission bits of the files the storage creates, before the umask. Files created
+	// before it was changed keep their mode, except LOCK, which loses the bits FileMode lacks whenever a
+	// writable storage takes the lock.
+	//
+	// The default value is 0600.
+	FileMode os.FileMode
+
+	// DirMode is the permission bits of the database directory, when the storage creates it, and of its
+	// quarantine subdirectory, before the umask.
+	//
+	// The default value is 0700.
+	DirMode os.FileMode
+
+	// PermissionCheck is what opening does when the database directory is group or world accessible, see
+	// the PermissionCheck constants.
+	//
+	// The default value is PermissionCheckWarn.
+	PermissionCheck PermissionCheck
+
+	// ChunkSize is the plaintext size, in bytes, of the chunks new files are sealed in. Smaller chunks
+	// lose less to damage and cost more in overhead. Files record their own chunk size, so it can be
+	// changed at any time. Values above 64MiB are lowered to it.
+	//
+	// The default value is 64KiB.
+	ChunkSize int
+
+	// Metrics is where the storage records its metrics. Passing the same Metrics to several storages sums
+	// theirs.
+	//
+	// The default value is nil, which gives the storage a Metrics of its own.
+	Metrics *Metrics
+
+	// MaxFileSize is the size, in bytes, of the largest file the storage reads. Files are read whole into
+	// memory, so larger ones are refused with ErrFileTooLarge instead. It must fit the largest table,
+	// journal and manifest the database writes.
+	//
+	// The default value is 1GiB.
+	MaxFileSize int64
+
+	// Debug records the stack that opened every reader and writer in its Handle, see
+	// Storage.OpenHandles, so that leaks reported by Close can be traced back. Costs a stack trace per
+	// open file.
+	//
+	// The default value is false.
+	Debug bool
+}
+
+func (o *Options) GetReadOnly() bool {
+	if o == nil {
+		return false
+	}
+	return o.ReadOnly
+}
+
+func (o *Options) GetHooks() *Hooks {
+	if o == nil {
+		return nil
+	}
+	return o.Hooks
+}
+
+func (o *Options) GetMemoryBudget() int64 {
+	if o == nil || o.MemoryBudget < 0 {
+		return 0
+	}
+	return o.MemoryBudget
+}
+
+func (o *Options) GetDisableCoreDumps() bool {
+	if o == nil {
+		return false
+	}
+	return o.DisableCoreDumps
+}
+
+func (o *Options) GetConcurrency() int {
+	if o == nil || o.Concurrency < 1 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return o.Concurrency
+}
+
+func (o *Options) GetWriteBufferSize() int {
+	if o == nil || o.WriteBufferSize <= 0 {
+		return defaultWriteBufferSize
+	}
+	return o.WriteBufferSize
+}
+
+func (o *Options) GetDurability() Durability {
+	if o == nil || o.Durability < DurabilityStandard || o.Durability > DurabilityRelaxed {
+		return DurabilityStandard
+	}
+	return o.Durability
+}
+
+func (o *Options) GetSyncInterval() time.Duration {
+	if o == nil || o.SyncInterval <= 0 {
+		return defaultSyncInterval
+	}
+	return o.SyncInterval
+}
+
+func (o *Options) GetQuarantine() bool {
+	if o == nil {
+		return false
+	}
+	return o.Quarantine
+}
+
+func (o *Options) GetVerifyWrites() bool {
+	if o == nil {
+		return false
+	}
+	return o.VerifyWrites
+}
+
+func (o *Options) GetCipherSuite() CipherSuite {
+	if o == nil || o.CipherSuite < CipherAESGCM || o.CipherSuite > CipherAES256GCM {
+		return CipherAESGCM
+	}
+	return o.CipherSuite
+}
+
+func (o *Options) GetKeySource() KeySource {
+	if o == nil {
+		return nil
+	}
+	return o.KeySource
+}
+
+func (o *Options) GetLogger() Logger {
+	if o == nil {
+		return nil
+	}
+	return o.Logger
+}
+
+func (o *Options) GetFileMode() os.FileMode {
+	if o == nil || o.FileMode&os.ModePerm == 0 {
+		return defaultFileMode
+	}
+	return o.FileMode & os.ModePerm
+}
+
+func (o *Options) GetDirMode() os.FileMode {
+	if o == nil || o.DirMode&os.ModePerm == 0 {
+		return defaultDirMode
+	}
+	return o.DirMode & os.ModePerm
+}
+
+func (o *Options) GetChunkSize() int {
+	if o == nil || o.ChunkSize <= 0 {
+		return defaultChunkSize
+	}
+	if o.ChunkSize > maxChunkSize {
+		return maxChunkSize
+	}
+	return o.ChunkSize
+}
+
+func (o *Options) GetMetrics() *Metrics {
+	if o == nil {
+		return nil
+	}
+	return o.Metrics
+}
+
+func (o *Options) GetPermissionCheck() PermissionCheck {
+	if o == nil || o.PermissionCheck < PermissionCheckWarn || o.PermissionCheck > PermissionCheckOff {
+		return PermissionCheckWarn
+	}
+	return o.PermissionCheck
+}
+
+func (o *Options) GetMaxFileSize() int64 {
+	if o == nil || o.MaxFileSize <= 0 {
+		return defaultMaxFileSize
+	}
+	// The whole file must fit a slice
+	if maxInt := int64(^uint(0) >> 1); o.MaxFileSize > maxInt {
+		return maxInt
+	}
+	return o.MaxFileSize
+}
+
+func (o *Options) GetDebug() bool {
+	if o == nil {
+		return false
+	}
+	return o.Debug
+}
+
+func (o *Options) GetSecondary() bool {
+	if o == nil {
+		return false
+	}
+	return o.Secondary
+}
@@ -0,0 +1,240 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_options_test.go: Optional parameters of the encrypted storage
+ *
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOptions_Defaults(t *testing.T) {
+	var o *Options
+	if o.GetCipherSuite() != CipherAESGCM || o.GetKeySource() != nil || o.GetLogger() != nil || o.GetMetrics() != nil {
+		t.Fatal("expected no cipher, key source, logger or metrics to be set")
+	}
+	if o.GetFileMode() != 0600 || o.GetDirMode() != 0700 || o.GetChunkSize() != defaultChunkSize {
+		t.Fatalf("expected private modes and the default chunk size, got %v %v %d", o.GetFileMode(), o.GetDirMode(), o.GetChunkSize())
+	}
+	if (&Options{ChunkSize: 1 << 30}).GetChunkSize() != maxChunkSize {
+		t.Fatal("expected the chunk size to be capped")
+	}
+}
+
+func TestOptions_CipherSuite(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	if _, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{CipherSuite: CipherAES256GCM}); err == nil {
+		t.Fatal("expected a 16 byte key to be refused by AES-256")
+	}
+	fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{CipherSuite: CipherAES128GCM})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	fs.Close()
+}
+
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Log(str string) {
+	l.mu.Lock()
+	l.lines = append(l.lines, str)
+	l.mu.Unlock()
+}
+
+func TestOptions_KeySourceLoggerMetrics(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	var given []byte
+	source := KeyFunc(func() ([]byte, error) {
+		given = append([]byte(nil), testKey...)
+		return given, nil
+	})
+	if _, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{KeySource: source}); err != errKeyAndSource {
+		t.Fatalf("expected a key and a key source to be refused, got %v", err)
+	}
+
+	logger := &testLogger{}
+	metrics := NewMetrics()
+	fs, err := OpenEncryptedFileWithOptions(temp, nil, &Options{KeySource: source, Logger: logger, Metrics: metrics})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	if !bytes.Equal(given, make([]byte, len(testKey))) {
+		t.Fatal("expected the key from the source to be wiped")
+	}
+	if fs.Metrics() != metrics {
+		t.Fatal("expected the given metrics to be used")
+	}
+
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	writeTestFile(t, fs, fd, []byte("data"))
+	fs.Log("hello")
+	fs.Close()
+
+	// The key came from the source
+	other, err := OpenEncryptedFile(temp, testKey, true)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	got, err := readTestFile(other, fd)
+	other.Close()
+	if err != nil || string(got) != "data" {
+		t.Fatalf("expected the file to be readable with the key, got %q and %v", got, err)
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.lines) == 0 || logger.lines[len(logger.lines)-1] != "hello" {
+		t.Fatalf("expected the message to be logged, got %q", logger.lines)
+	}
+	if metrics.Snapshot().SealedBytes["table"] != 4 {
+		t.Fatal("expected the write to be counted in the given metrics")
+	}
+}
+
+func TestOptions_ModesAndChunkSize(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	dir := filepath.Join(temp, "db")
+	const chunkSize = 4096
+	fs, err := OpenEncryptedFileWithOptions(dir, testKey, &Options{FileMode: 0600, DirMode: 0700, ChunkSize: chunkSize})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	data := bytes.Repeat([]byte("x"), 3*chunkSize)
+	writeTestFile(t, fs, fd, data)
+	if got, err := readTestFile(fs, fd); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected the data back, got %d bytes and %v", len(got), err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, fsGenName(fd)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := headerLen(formatVersion) + 3*(chunkOverhead(formatVersion)+chunkSize); len(b) != want {
+		t.Fatalf("expected %d bytes of 4KiB chunks, got %d", want, len(b))
+	}
+
+	for name, want := range map[string]os.FileMode{"": 0700, fsGenName(fd): 0600, "LOCK": 0600} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != want {
+			t.Fatalf("expected %q to have mode %v, got %v", name, want, fi.Mode().Perm())
+		}
+	}
+}
+
+func TestOptions_PermissionCheck(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	// New databases are private
+	dir := filepath.Join(temp, "db")
+	fs, err := OpenEncryptedFile(dir, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	writeTestFile(t, fs, fd, []byte("data"))
+	fs.Close()
+	for name, want := range map[string]os.FileMode{"": 0700, fsGenName(fd): 0600, "LOCK": 0600} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != want {
+			t.Fatalf("expected %q to have mode %v, got %v", name, want, fi.Mode().Perm())
+		}
+	}
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenEncryptedFileWithOptions(dir, testKey, &Options{PermissionCheck: PermissionCheckRefuse}); !errors.Is(err, ErrInsecurePermissions) {
+		t.Fatalf("expected an open directory to be refused, got %v", err)
+	}
+	for _, check := range []PermissionCheck{PermissionCheckWarn, PermissionCheckOff} {
+		logger := &testLogger{}
+		fs, err := OpenEncryptedFileWithOptions(dir, testKey, &Options{PermissionCheck: check, Logger: logger})
+		if err != nil {
+			t.Fatalf("%s: OpenFile: got error: %v", check, err)
+		}
+		fs.Close()
+		if warned := len(logger.lines) > 0; warned != (check == PermissionCheckWarn) {
+			t.Fatalf("%s: got log %q", check, logger.lines)
+		}
+	}
+
+	// Without a logger, the first warning goes to the standard logger, and the rest nowhere
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	stdWarning = sync.Once{}
+	for i := 0; i < 2; i++ {
+		fs, err = OpenEncryptedFile(dir, testKey, false)
+		if err != nil {
+			t.Fatal("OpenFile: got error: ", err)
+		}
+		fs.Close()
+	}
+	if n := strings.Count(out.String(), "accessible by other users"); n != 1 {
+		t.Fatalf("expected one warning on the standard logger, got %q", out.String())
+	}
+
+	// A LOCK left looser than FileMode is tightened by the next writer
+	lock := filepath.Join(dir, "LOCK")
+	if err := os.Chmod(lock, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = OpenEncryptedFileWithOptions(dir, testKey, &Options{PermissionCheck: PermissionCheckOff})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	fs.Close()
+	fi, err := os.Stat(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected LOCK to be tightened to 0600, got %v", fi.Mode().Perm())
+	}
+}
@@ -0,0 +1,89 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_perm.go: Checks of the database directory's permissions
+ *
+ */
+
+package aesgcm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// PermissionCheck selects what opening a storage does when its directory can be accessed by users other
+// than its owner. Encrypted files still give away their sizes, timestamps and number to anyone who can
+// list or read them.
+type PermissionCheck int
+
+const (
+	// PermissionCheckWarn logs a warning through Options.Logger, and opens the storage anyway. Without a
+	// logger the first warning of the process goes to the standard log package, and the rest are dropped.
+	PermissionCheckWarn PermissionCheck = iota
+
+	// PermissionCheckRefuse fails opening with ErrInsecurePermissions.
+	PermissionCheckRefuse
+
+	// PermissionCheckOff skips the check.
+	PermissionCheckOff
+)
+
+var permissionCheckNames = []string{"warn", "refuse", "off"}
+
+func (c PermissionCheck) String() string {
+	if c >= 0 && int(c) < len(permissionCheckNames) {
+		return permissionCheckNames[c]
+	}
+	return fmt.Sprintf("PermissionCheck(%d)", int(c))
+}
+
+// ErrInsecurePermissions is returned under PermissionCheckRefuse when the database directory is group or
+// world accessible
+var ErrInsecurePermissions = errors.New("leveldb/aesgcm: database directory is accessible by other users")
+
+// stdWarning limits the warnings sent to the standard log package to one per process
+var stdWarning sync.Once
+
+// checkDirMode applies the permission check to the database directory. Windows has no permission bits, so
+// nothing is checked there.
+func checkDirMode(path string, fi os.FileInfo, check PermissionCheck, logger Logger) error {
+	if check == PermissionCheckOff || runtime.GOOS == "windows" {
+		return nil
+	}
+	mode := fi.Mode().Perm()
+	if mode&0077 == 0 {
+		return nil
+	}
+	if check == PermissionCheckRefuse {
+		return fmt.Errorf("%w: %s has mode %v", ErrInsecurePermissions, path, mode)
+	}
+	msg := fmt.Sprintf("aesgcm: %s has mode %v, accessible by other users", path, mode)
+	if logger != nil {
+		logger.Log(msg)
+	} else {
+		// Most callers set no logger, and the warning must not go unseen, but neither flood their log
+		stdWarning.Do(func() { log.Print(msg) })
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_pipeline.go: Ordered worker pool used to seal and open chunks in parallel
+ *
+ */
+
+package aesgcm
+
+import (
+	"sync"
+)
+
+type pipelineResult struct {
+	b   []byte
+	err error
+}
+
+// runPipeline runs jobs 0 to n-1 on up to workers goroutines and hands their results to emit strictly in
+// job order. At most 2*workers jobs are started ahead of the last emitted one, which bounds the memory held
+// by results waiting for slower earlier jobs. Results are pooled buffers: emit takes ownership of the ones
+// it is given, and those left over after an error are returned to the pool.
+func runPipeline(workers, n int, work func(i int) ([]byte, error), emit func(i int, b []byte) error) error {
+	if workers <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			b, err := work(i)
+			if err != nil {
+				return err
+			}
+			if err := emit(i, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	slots := make([]chan pipelineResult, n)
+	for i := range slots {
+		slots[i] = make(chan pipelineResult, 1)
+	}
+	tokens := make(chan struct{}, 2*workers)
+	jobs := make(chan int)
+	quit := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				b, err := work(i)
+				slots[i] <- pipelineResult{b, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i := 0; i < n; i++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-quit:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var err error
+	i := 0
+	for ; i < n && err == nil; i++ {
+		r := <-slots[i]
+		<-tokens
+		if err = r.err; err == nil {
+			err = emit(i, r.b)
+		} else if r.b != nil {
+			putBuffer(r.b)
+		}
+	}
+	if err != nil {
+		close(quit)
+	}
+	wg.Wait()
+	// Only reached with jobs left over after an error
+	for ; i < n; i++ {
+		select {
+		case r := <-slots[i]:
+			if r.b != nil {
+				putBuffer(r.b)
+			}
+		default:
+		}
+	}
+	return err
+}
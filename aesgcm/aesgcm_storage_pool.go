@@ -0,0 +1,109 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_pool.go: Pool of plaintext and ciphertext buffers which are wiped before reuse
+ *
+ */
+
+package aesgcm
+
+import (
+	"sync"
+)
+
+// Buffers are pooled in power of two size classes from 4KiB up to 64MiB. Larger buffers are
+// allocated directly and only wiped when released.
+const (
+	minPoolShift = 12
+	maxPoolShift = 26
+)
+
+// The pools hold *[]byte, a []byte would allocate its slice header on every Put. The pointers themselves
+// are recycled through headerPool while their buffer is out, so neither Get nor Put allocates once warm.
+var (
+	bufferPools [maxPoolShift - minPoolShift + 1]sync.Pool
+	headerPool  sync.Pool
+)
+
+func poolClass(n int) int {
+	c := 0
+	for n > 1<<uint(minPoolShift+c) {
+		c++
+	}
+	return c
+}
+
+// getBuffer returns a slice of length n from the pool. Its contents are zero.
+func getBuffer(n int) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+	c := poolClass(n)
+	if c >= len(bufferPools) {
+		return make([]byte, n)
+	}
+	if p, ok := bufferPools[c].Get().(*[]byte); ok {
+		b := *p
+		*p = nil
+		headerPool.Put(p)
+		return b[:n]
+	}
+	return make([]byte, n, 1<<uint(minPoolShift+c))
+}
+
+// putBuffer wipes the whole capacity of b and returns it to the pool when it came from one. b must not be
+// used afterwards.
+func putBuffer(b []byte) {
+	b = b[:cap(b)]
+	wipe(b)
+	if len(b) == 0 {
+		return
+	}
+	c := poolClass(len(b))
+	if c < len(bufferPools) && len(b) == 1<<uint(minPoolShift+c) {
+		p, ok := headerPool.Get().(*[]byte)
+		if !ok {
+			p = new([]byte)
+		}
+		*p = b
+		bufferPools[c].Put(p)
+	}
+}
+
+// growBuffer returns b with room for at least n more bytes, moving the contents to a larger pooled buffer
+// (and releasing the old one) when needed.
+func growBuffer(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b
+	}
+	size := 2 * cap(b)
+	if size < len(b)+n {
+		size = len(b) + n
+	}
+	nb := getBuffer(size)[:len(b)]
+	copy(nb, b)
+	putBuffer(b)
+	return nb
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
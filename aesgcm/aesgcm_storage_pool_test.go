@@ -0,0 +1,63 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_pool_test.go: Wiping and reuse of pooled buffers
+ *
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBufferPool_Wipe(t *testing.T) {
+	for _, n := range []int{1, 4096, 5000, 1 << 20} {
+		b := getBuffer(n)
+		if len(b) != n {
+			t.Fatalf("expected length %d, got %d", n, len(b))
+		}
+		for i := range b {
+			b[i] = 0xaa
+		}
+		full := b[:cap(b)]
+		putBuffer(b)
+		if !bytes.Equal(full, make([]byte, len(full))) {
+			t.Fatalf("buffer of %d bytes not wiped on release", n)
+		}
+		if b := getBuffer(n); !bytes.Equal(b, make([]byte, n)) {
+			t.Fatalf("buffer of %d bytes not zero when reused", n)
+		}
+	}
+}
+
+func TestBufferPool_Grow(t *testing.T) {
+	b := getBuffer(0)
+	for i := 0; i < 10000; i++ {
+		b = growBuffer(b, 1)
+		b = append(b, byte(i))
+	}
+	for i := range b {
+		if b[i] != byte(i) {
+			t.Fatalf("lost data at %d while growing", i)
+		}
+	}
+	putBuffer(b)
+}
@@ -0,0 +1,194 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_quarantine.go: Quarantine of files that fail authentication
+ *
+ */
+
+package aesgcm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// QuarantineDir is the subdirectory of the storage files are quarantined in
+const QuarantineDir = "quarantine"
+
+const quarantineReportSuffix = ".json"
+
+// QuarantineReport describes a quarantined file. It is stored as JSON next to the file.
+type QuarantineReport struct {
+	// Name of the file inside the quarantine directory, usually the name it had in the storage
+	Name string `json:"name"`
+	// Type and number of the file in the storage
+	Type string `json:"type"`
+	Num  int64  `json:"num"`
+	Size int64  `json:"size"`
+	// Chunk that failed authentication, or -1 for the header and for files written before chunking
+	Chunk int64     `json:"chunk"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// quarantineFile moves a file that failed authentication out of the storage, so goleveldb won't try it again,
+// and writes its report. Files failing with ErrWrongKey, and any file while no other file of the storage
+// authenticates, are left alone: a mistyped key must not empty the database. Failures are only logged, the
+// caller returns the authentication error anyway.
+func (fs *aesgcmStorage) quarantineFile(fd storage.FileDesc, cause error) {
+	var aerr *AuthError
+	if !errors.As(cause, &aerr) || errors.Is(aerr, ErrWrongKey) {
+		return
+	}
+	// A wrong key fails every file, so only quarantine once another file proves the key right
+	if ok, err := fs.keyConfirmed(); !ok {
+		fs.Log(fmt.Sprintf("quarantine %s: key not confirmed by any file, leaving it in place: %v", fd, err))
+		return
+	}
+	dir, err := fs.dir.subdir(QuarantineDir, fs.dirMode, true)
+	if err != nil {
+		fs.Log(fmt.Sprintf("quarantine %s: %v", fd, err))
+		return
+	}
+	defer dir.close()
+	src := fsGenName(fd)
+	fi, err := fs.statFile(src)
+	if err != nil {
+		// Already quarantined by a concurrent Open
+		if !os.IsNotExist(err) {
+			fs.Log(fmt.Sprintf("quarantine %s: %v", fd, err))
+		}
+		return
+	}
+
+	// The number may come back, e.g. quarantined by an earlier recovery, so never overwrite
+	names, err := dir.names()
+	if err != nil {
+		fs.Log(fmt.Sprintf("quarantine %s: %v", fd, err))
+		return
+	}
+	taken := make(map[string]bool, len(names))
+	for _, name := range names {
+		taken[name] = true
+	}
+	name := src
+	for i := 1; taken[name]; i++ {
+		name = fmt.Sprintf("%s.%d", src, i)
+	}
+	if err := fs.dir.move(src, dir, name); err != nil {
+		if !os.IsNotExist(err) {
+			fs.Log(fmt.Sprintf("quarantine %s: %v", fd, err))
+		}
+		return
+	}
+
+	report, err := json.MarshalIndent(&QuarantineReport{
+		Name:  name,
+		Type:  fd.Type.String(),
+		Num:   fd.Num,
+		Size:  fi.Size(),
+		Chunk: aerr.Chunk,
+		Error: aerr.Error(),
+		Time:  time.Now().UTC(),
+	}, "", "\t")
+	if err == nil {
+		err = writeReport(dir, name+quarantineReportSuffix, append(report, '\n'), fs.fileMode)
+	}
+	if err == nil {
+		err = dir.sync()
+	}
+	if err == nil {
+		err = fs.dir.sync()
+	}
+	if err != nil {
+		fs.Log(fmt.Sprintf("quarantine %s: %v", fd, err))
+	}
+	fs.Log(fmt.Sprintf("quarantined %s as %s: %v", fd, name, aerr))
+}
+
+// writeReport creates the report name in dir and syncs it
+func writeReport(dir *dirHandle, name string, report []byte, perm os.FileMode) error {
+	f, err := openRegular(dir, name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(report)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (fs *aesgcmStorage) Quarantined() ([]QuarantineReport, error) {
+	if err := fs.acquire(); err != nil {
+		return nil, err
+	}
+	defer fs.release()
+
+	reports := []QuarantineReport{}
+	dir, err := fs.dir.subdir(QuarantineDir, 0, false)
+	if os.IsNotExist(err) {
+		return reports, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer dir.close()
+	names, err := dir.names()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, quarantineReportSuffix) {
+			continue
+		}
+		f, err := openRegular(dir, name, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		var r QuarantineReport
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, fmt.Errorf("leveldb/aesgcm: %s: %v", filepath.Join(QuarantineDir, name), err)
+		}
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if !reports[i].Time.Equal(reports[j].Time) {
+			return reports[i].Time.Before(reports[j].Time)
+		}
+		return reports[i].Name < reports[j].Name
+	})
+	return reports, nil
+}
@@ -0,0 +1,176 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_quarantine_test.go: Quarantine of files that fail authentication
+ *
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"errors"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{Quarantine: true})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	// Proves the key right, nothing is quarantined until a file does
+	writeTestFile(t, fs, storage.FileDesc{Type: storage.TypeJournal, Num: 2}, []byte("journal"))
+
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	for round := 0; round < 2; round++ {
+		writeTestFile(t, fs, fd, bytes.Repeat([]byte("x"), 1000))
+		name := filepath.Join(temp, fsGenName(fd))
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[len(b)-10] ^= 1
+		if err := ioutil.WriteFile(name, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fs.Open(fd); !lerrors.IsCorrupted(err) {
+			t.Fatalf("expected a corruption error, got %v", err)
+		}
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("expected the file to be moved, got %v", err)
+		}
+		if fds, err := fs.List(storage.TypeTable); err != nil || len(fds) != 0 {
+			t.Fatalf("expected no tables left, got %v, %v", fds, err)
+		}
+	}
+
+	reports, err := fs.Quarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 reports, got %d", len(reports))
+	}
+	// The second file with the same name doesn't overwrite the first
+	for i, want := range []string{"000001.ldb", "000001.ldb.1"} {
+		r := reports[i]
+		if r.Name != want || r.Type != "table" || r.Num != 1 || r.Chunk != 0 || r.Error == "" {
+			t.Fatalf("unexpected report %+v", r)
+		}
+		fi, err := os.Stat(filepath.Join(temp, QuarantineDir, r.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != r.Size {
+			t.Fatalf("expected %d bytes quarantined, got %d", r.Size, fi.Size())
+		}
+	}
+}
+
+func TestQuarantine_Disabled(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	writeTestFile(t, fs, fd, []byte("data"))
+	name := filepath.Join(temp, fsGenName(fd))
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 1
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open(fd); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Fatalf("expected the file to stay in place, got %v", err)
+	}
+	if reports, err := fs.Quarantined(); err != nil || len(reports) != 0 {
+		t.Fatalf("expected nothing quarantined, got %v, %v", reports, err)
+	}
+}
+
+func TestQuarantine_WrongKey(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	manifest := storage.FileDesc{Type: storage.TypeManifest, Num: 1}
+	table := storage.FileDesc{Type: storage.TypeTable, Num: 2}
+	writeTestFile(t, fs, manifest, []byte("manifest"))
+	if err := fs.SetMeta(manifest); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, fs, table, []byte("table"))
+	fs.Close()
+
+	wrongKey := append([]byte(nil), testKey...)
+	wrongKey[0] ^= 1
+	fs, err = OpenEncryptedFileWithOptions(temp, wrongKey, &Options{Quarantine: true})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	for _, fd := range []storage.FileDesc{manifest, table} {
+		if _, err := fs.Open(fd); !errors.Is(Cause(err), ErrWrongKey) {
+			t.Fatalf("%s: expected a wrong key error, got %v", fd, err)
+		}
+	}
+	if err := fs.CheckKey(); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("expected the key check to fail, got %v", err)
+	}
+	fs.Close()
+
+	if _, err := os.Stat(filepath.Join(temp, QuarantineDir)); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing quarantined with a wrong key, got %v", err)
+	}
+	fs, err = OpenEncryptedFile(temp, testKey, true)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+	if err := fs.CheckKey(); err != nil {
+		t.Fatalf("expected the right key to pass, got %v", err)
+	}
+	if b, err := readTestFile(fs, manifest); err != nil || string(b) != "manifest" {
+		t.Fatalf("expected the manifest to be left in place, got %q, %v", b, err)
+	}
+}
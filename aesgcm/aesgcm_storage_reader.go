@@ -24,34 +24,177 @@
 package aesgcm
 
 import (
-	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
+var errNegativeOffset = errors.New("leveldb/aesgcm: negative offset")
+
+// aesgcmReader serves reads from the decrypted contents of a file. The file stays open for the lifetime of
+// the reader so that, when the memory budget evicts the plaintext, it can be decrypted again on demand.
+// The plaintext comes from the buffer pool and goes back to it, wiped, on eviction and Close.
 type aesgcmReader struct {
-	*bytes.Reader
 	fs     *aesgcmStorage
 	fd     storage.FileDesc
+	fp     *os.File
+	size   int64
+	handle *Handle
+
+	mu     sync.RWMutex
+	plain  []byte // nil while evicted
+	pos    int64
 	closed bool
+
+	// Position in the budget's LRU list, guarded by the budget's mutex
+	elem *list.Element
 }
 
-func newReader(b []byte, fd storage.FileDesc, fs *aesgcmStorage) *aesgcmReader {
-	return &aesgcmReader{
-		Reader: bytes.NewReader(b),
+func newReader(fp *os.File, plain []byte, fd storage.FileDesc, fs *aesgcmStorage) *aesgcmReader {
+	r := &aesgcmReader{
 		fs:     fs,
 		fd:     fd,
-		closed: false,
+		fp:     fp,
+		size:   int64(len(plain)),
+		plain:  plain,
+		handle: fs.handles.add(fd, false),
+	}
+	fs.budget.add(r)
+	return r
+}
+
+// acquire returns the plaintext with at least a read lock held, decrypting it again if it was evicted.
+// The caller must call release(exclusive) when done.
+func (r *aesgcmReader) acquire() (plain []byte, exclusive bool, err error) {
+	r.mu.RLock()
+	if r.closed {
+		r.mu.RUnlock()
+		return nil, false, storage.ErrClosed
+	}
+	if r.plain != nil {
+		r.fs.budget.touch(r)
+		return r.plain, false, nil
+	}
+	r.mu.RUnlock()
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, true, storage.ErrClosed
+	}
+	if r.plain == nil {
+		plain, err := r.fs.decryptFile(r.fd, r.fp)
+		if err != nil {
+			r.mu.Unlock()
+			return nil, true, err
+		}
+		r.plain = plain
+		r.fs.budget.add(r)
+	}
+	return r.plain, true, nil
+}
+
+func (r *aesgcmReader) release(exclusive bool) {
+	if exclusive {
+		r.mu.Unlock()
+		// Decrypting again may have pushed usage over the budget
+		r.fs.budget.trim()
+	} else {
+		r.mu.RUnlock()
+	}
+}
+
+// evict drops the plaintext after the budget stopped accounting for it
+func (r *aesgcmReader) evict() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.elem == nil && r.plain != nil {
+		putBuffer(r.plain)
+		r.plain = nil
 	}
 }
 
-func (r aesgcmReader) Close() error {
-	r.fs.mu.Lock()
-	defer r.fs.mu.Unlock()
+func (r *aesgcmReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	plain, exclusive, err := r.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer r.release(exclusive)
+	if off >= int64(len(plain)) {
+		return 0, io.EOF
+	}
+	n := copy(p, plain[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *aesgcmReader) Read(p []byte) (int, error) {
+	// Read moves the position, so it needs the lock for itself
+	r.mu.Lock()
+	pos := r.pos
+	r.mu.Unlock()
+
+	n, err := r.ReadAt(p, pos)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	r.mu.Lock()
+	r.pos = pos + int64(n)
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *aesgcmReader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.closed {
-		return storage.ErrClosed
+		return 0, storage.ErrClosed
+	}
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.pos + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("leveldb/aesgcm: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errNegativeOffset
+	}
+	r.pos = abs
+	return abs, nil
+}
+
+func (r *aesgcmReader) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return r.fs.doubleClose(r.handle)
 	}
 	r.closed = true
-	r.fs.open -= 1
-	// TODO: (maybe) push the bytes back into a pool?
-	return nil
+	r.fs.handles.remove(r.handle)
+	r.fs.budget.remove(r)
+	if r.plain != nil {
+		putBuffer(r.plain)
+		r.plain = nil
+	}
+	err := r.fp.Close()
+	r.mu.Unlock()
+
+	r.fs.release()
+	r.fs.metrics.readerOpened(-1)
+	return err
 }
@@ -0,0 +1,141 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_salvage.go: Chunk by chunk reading of damaged files
+ *
+ */
+
+package aesgcm
+
+import (
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// DamagedRange is a range of a salvaged file's plaintext that failed authentication
+type DamagedRange struct {
+	Off, Len int64
+	// Index of the chunk, or -1 for files written before chunking
+	Chunk int64
+	Err   error
+}
+
+// SalvageResult is what Salvage could read of a file
+type SalvageResult struct {
+	Fd storage.FileDesc
+	// The file's plaintext, with the damaged ranges filled with zeroes. It is the caller's to wipe.
+	Data    []byte
+	Damaged []DamagedRange
+	// Ciphertext bytes at the end of the file that couldn't even be split into chunks, and whose plaintext
+	// is missing from Data entirely
+	Lost int64
+	// Set when the header failed authentication. Chunks are authenticated on their own, so they are still
+	// read, but with the wrong key none of them will be.
+	HeaderErr error
+}
+
+// Intact tells whether the whole file was read
+func (r *SalvageResult) Intact() bool {
+	return len(r.Damaged) == 0 && r.Lost == 0 && r.HeaderErr == nil
+}
+
+// Salvage reads whatever still authenticates of a damaged file. Unlike Open, which rejects a file as soon as
+// any part of it fails, every chunk is authenticated on its own: those that pass are returned, those that
+// don't are zeroed and listed, so goleveldb's own block checksums then pick out the healthy blocks of a
+// table or records of a journal. Chunks are found by their length prefixes, so reading stops where one is
+// damaged, and everything after it is counted as lost. Files written before chunking are either read
+// whole or reported damaged whole.
+//
+// Errors are only returned when the file can't be read at all.
+func (fs *aesgcmStorage) Salvage(fd storage.FileDesc) (*SalvageResult, error) {
+	if !storage.FileDescOk(fd) {
+		return nil, storage.ErrInvalidFile
+	}
+	if err := fs.acquire(); err != nil {
+		return nil, err
+	}
+	defer fs.release()
+
+	of, err := fs.openFile(fsGenName(fd), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer of.Close()
+	crypt, err := fs.readCiphertext(fd, of)
+	if err != nil {
+		return nil, err
+	}
+	defer putBuffer(crypt)
+
+	res := &SalvageResult{Fd: fd}
+	if !isChunked(crypt) {
+		plain, err := fs.openLegacy(fd, crypt)
+		if err != nil {
+			size := int64(len(crypt) - fs.cyp.NonceSize() - fs.cyp.Overhead())
+			if size < 0 {
+				size = 0
+			}
+			res.Data = make([]byte, size)
+			res.Damaged = append(res.Damaged, DamagedRange{Len: size, Chunk: -1, Err: err})
+			return res, nil
+		}
+		res.Data = append([]byte(nil), plain...)
+		putBuffer(plain)
+		return res, nil
+	}
+
+	chunkSize, version, err := fs.openHeader(fd, crypt)
+	if err != nil {
+		res.HeaderErr = err
+		// A damaged tag or checksum still leaves the chunks to be found, as long as the chunk size is sane
+		if chunkSize == 0 {
+			res.Lost = int64(len(crypt))
+			return res, nil
+		}
+	}
+
+	// The plaintext is shorter than the ciphertext, so Data never moves and leaves no stray copy behind
+	res.Data = make([]byte, 0, len(crypt))
+	off := headerLen(version)
+	for index := uint64(0); off < len(crypt); index++ {
+		ref, err := parseChunk(crypt, off, chunkSize, version)
+		if err != nil {
+			break
+		}
+		ref.index = index
+		plainOff := len(res.Data)
+		res.Data = append(res.Data, make([]byte, ref.sealed-gcmTagSize)...)
+		if err := fs.openChunk(fd, crypt, &ref, version, res.Data[plainOff:]); err != nil {
+			wipe(res.Data[plainOff:])
+			res.Damaged = append(res.Damaged, DamagedRange{
+				Off:   int64(plainOff),
+				Len:   int64(ref.sealed - gcmTagSize),
+				Chunk: int64(index),
+				Err:   err,
+			})
+		}
+		off = ref.end(version)
+		if ref.flags&chunkFinal != 0 {
+			break
+		}
+	}
+	res.Lost = int64(len(crypt) - off)
+	return res, nil
+}
@@ -0,0 +1,130 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_salvage_test.go: Chunk by chunk reading of damaged files
+ *
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSalvage(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	data := make([]byte, 5*defaultChunkSize-100)
+	rand.Read(data)
+	writeTestFile(t, fs, fd, data)
+	name := filepath.Join(temp, fsGenName(fd))
+	orig, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := headerLen(formatVersion)
+	chunk := chunkOverhead(formatVersion) + defaultChunkSize
+
+	res, err := fs.Salvage(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Intact() || !bytes.Equal(res.Data, data) {
+		t.Fatal("expected an intact file to be salvaged whole")
+	}
+
+	// A damaged chunk is zeroed and reported, the others are returned
+	b := append([]byte(nil), orig...)
+	b[hdr+2*chunk+100] ^= 1
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err = fs.Salvage(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Damaged) != 1 || res.Lost != 0 || res.HeaderErr != nil {
+		t.Fatalf("expected a single damaged chunk, got %+v", res.Damaged)
+	}
+	d := res.Damaged[0]
+	if d.Chunk != 2 || d.Off != 2*defaultChunkSize || d.Len != defaultChunkSize || !errors.Is(d.Err, ErrAuthFailed) {
+		t.Fatalf("unexpected damaged range %+v", d)
+	}
+	want := append([]byte(nil), data...)
+	wipe(want[d.Off : d.Off+d.Len])
+	if !bytes.Equal(res.Data, want) {
+		t.Fatal("expected the other chunks to be returned")
+	}
+
+	// A damaged length prefix loses everything from there on
+	b = append([]byte(nil), orig...)
+	b[hdr+3*chunk+2] ^= 0x80
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err = fs.Salvage(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Damaged) != 0 || res.Lost != int64(len(orig)-hdr-3*chunk) || !bytes.Equal(res.Data, data[:3*defaultChunkSize]) {
+		t.Fatalf("expected the first 3 chunks and %d lost bytes, got %d bytes and %d lost", len(orig)-hdr-3*chunk, len(res.Data), res.Lost)
+	}
+}
+
+func TestSalvage_Legacy(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	// A file written before chunking, damaged
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 2}
+	nonce := make([]byte, 12)
+	crypt := fs.(*aesgcmStorage).cyp.Seal(nonce, nonce, []byte("legacy contents"), fdGenAD(fd))
+	crypt[len(crypt)-1] ^= 1
+	if err := ioutil.WriteFile(filepath.Join(temp, fsGenName(fd)), crypt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := fs.Salvage(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Damaged) != 1 || res.Damaged[0].Len != int64(len("legacy contents")) || res.Damaged[0].Chunk != -1 {
+		t.Fatalf("expected the whole file to be damaged, got %+v", res.Damaged)
+	}
+}
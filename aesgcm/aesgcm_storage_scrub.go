@@ -0,0 +1,352 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_scrub.go: Background verification of every file in the storage
+ *
+ */
+
+package aesgcm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+const (
+	defaultScrubInterval = time.Hour
+	defaultScrubRate     = 8 << 20
+)
+
+// errScrubStopped is returned by verifyPaced when pace stops it
+var errScrubStopped = errors.New("leveldb/aesgcm: verification stopped")
+
+// Verify reads, decrypts and authenticates a whole file a chunk at a time, without keeping its plaintext or
+// counting it as an open reader. It returns the number of ciphertext bytes in the file, and the error Open
+// would return.
+func (fs *aesgcmStorage) Verify(fd storage.FileDesc) (int64, error) {
+	return fs.verifyPaced(fd, nil)
+}
+
+// verifyPaced is Verify, calling pace, if set, before reading every chunk with the number of bytes read
+// since the last call. It stops with errScrubStopped when pace returns false.
+func (fs *aesgcmStorage) verifyPaced(fd storage.FileDesc, pace func(n int64) bool) (n int64, err error) {
+	if !storage.FileDescOk(fd) {
+		return 0, storage.ErrInvalidFile
+	}
+	if err := fs.acquire(); err != nil {
+		return 0, err
+	}
+	defer fs.release()
+
+	of, err := fs.openFile(fsGenName(fd), os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer of.Close()
+	fi, err := of.Stat()
+	if err != nil {
+		return 0, err
+	}
+	n = fi.Size()
+	if n > fs.maxFileSize {
+		err = fmt.Errorf("%w: %s is %d bytes", ErrFileTooLarge, fd, n)
+	} else {
+		err = fs.verifyChunks(fd, of, n, pace)
+	}
+	if err == errScrubStopped {
+		return n, err
+	}
+	if errors.Is(err, ErrAuthFailed) {
+		fs.metrics.authFailed()
+	}
+	fs.metrics.verified(n, err)
+	return n, err
+}
+
+// verifyChunks authenticates the chunks of an open file of size bytes one at a time, following the same
+// rules as scanChunks and openChunks. Files written before chunking, and files too short to hold a header,
+// are decrypted whole.
+func (fs *aesgcmStorage) verifyChunks(fd storage.FileDesc, of *os.File, size int64, pace func(n int64) bool) error {
+	if pace == nil {
+		pace = func(int64) bool { return true }
+	}
+	h := make([]byte, headerLen(formatVersion))
+	hn, err := of.ReadAt(h, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if h = h[:hn]; !isChunked(h) || isTornHeader(h) {
+		plain, err := fs.decryptFile(fd, of)
+		if err != nil {
+			return err
+		}
+		putBuffer(plain)
+		return nil
+	}
+
+	chunkSize, version, err := fs.openHeader(fd, h)
+	if err != nil {
+		return corrupted(fd, err)
+	}
+	buf := getBuffer(chunkOverhead(version) + chunkSize)
+	defer putBuffer(buf)
+	plain := getBuffer(chunkSize)
+	defer putBuffer(plain)
+
+	var (
+		index uint64
+		final bool
+		// First authentication failure since the last commit point, only an error once a commit follows
+		pending error
+	)
+	strict := requiresFinal(fd)
+	off := int64(headerLen(version))
+	paced := int64(0)
+	for off < size {
+		if final {
+			return corrupted(fd, errTrailingBytes)
+		}
+		if !pace(off - paced) {
+			return errScrubStopped
+		}
+		paced = off
+		n, err := of.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		ref, err := parseChunk(buf[:n], 0, chunkSize, version)
+		if err != nil {
+			if strict || !isTornTail(err) {
+				return corrupted(fd, err)
+			}
+			break
+		}
+		ref.index = index
+		index++
+		if err := fs.openChunk(fd, buf[:n], &ref, version, plain[:ref.sealed-gcmTagSize]); err != nil && pending == nil {
+			pending = err
+		}
+		off += int64(ref.end(version))
+		final = ref.flags&chunkFinal != 0
+		if ref.flags&(chunkFinal|chunkCommit) != 0 && pending != nil {
+			return corrupted(fd, pending)
+		}
+	}
+	if !final && strict {
+		return corrupted(fd, ErrTruncated)
+	}
+	return nil
+}
+
+// ScrubOptions holds the optional parameters of a Scrubber. A nil *ScrubOptions is valid.
+type ScrubOptions struct {
+	// Interval is the pause between the end of a pass over every file and the start of the next.
+	//
+	// The default value is 1 hour.
+	Interval time.Duration
+
+	// BytesPerSecond caps the rate at which files are read. Files are read a chunk at a time, pausing
+	// after each, so reads never run ahead of the cap by more than a chunk. Files written before chunking
+	// are read whole.
+	//
+	// The default value is 8MiB/s.
+	BytesPerSecond int64
+
+	// OnFailure is called, on the scrubber's goroutine, for every file that fails verification. The error
+	// is the one Open would return, a *storage.ErrCorrupted for damaged files. Files removed while the pass
+	// runs aren't failures.
+	//
+	// The default value is nil.
+	OnFailure func(fd storage.FileDesc, err error)
+}
+
+func (o *ScrubOptions) GetInterval() time.Duration {
+	if o == nil || o.Interval <= 0 {
+		return defaultScrubInterval
+	}
+	return o.Interval
+}
+
+func (o *ScrubOptions) GetBytesPerSecond() int64 {
+	if o == nil || o.BytesPerSecond <= 0 {
+		return defaultScrubRate
+	}
+	return o.BytesPerSecond
+}
+
+func (o *ScrubOptions) GetOnFailure() func(fd storage.FileDesc, err error) {
+	if o == nil {
+		return nil
+	}
+	return o.OnFailure
+}
+
+// Scrubber verifies every table, journal and manifest of a storage in the background, so silent
+// corruption of cold files is noticed before goleveldb needs them. Results go to the storage's metrics
+// and the OnFailure callback.
+type Scrubber struct {
+	stor Storage
+	o    *ScrubOptions
+
+	mu       sync.Mutex
+	verified map[storage.FileDesc]time.Time
+
+	quit chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// StartScrubber starts verifying every file of stor on its own goroutine, until Stop is called. The first
+// pass starts right away.
+func StartScrubber(stor Storage, o *ScrubOptions) *Scrubber {
+	s := &Scrubber{
+		stor:     stor,
+		o:        o,
+		verified: make(map[storage.FileDesc]time.Time),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Stop stops the scrubber, waiting for the file being verified, if any
+func (s *Scrubber) Stop() {
+	s.once.Do(func() { close(s.quit) })
+	<-s.done
+}
+
+// LastVerified returns when fd last passed verification, or the zero time if it never did
+func (s *Scrubber) LastVerified(fd storage.FileDesc) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.verified[fd]
+}
+
+// Verified returns when each file that passed verification last did. Files since removed are left out.
+func (s *Scrubber) Verified() map[storage.FileDesc]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[storage.FileDesc]time.Time, len(s.verified))
+	for fd, t := range s.verified {
+		m[fd] = t
+	}
+	return m
+}
+
+// wait pauses for d, returning false when the scrubber is stopped meanwhile
+func (s *Scrubber) wait(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-s.quit:
+			return false
+		default:
+			return true
+		}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-s.quit:
+		return false
+	}
+}
+
+func (s *Scrubber) run() {
+	defer close(s.done)
+	for {
+		if !s.pass() {
+			return
+		}
+		if !s.wait(s.o.GetInterval()) {
+			return
+		}
+	}
+}
+
+// verify paces the reads within fd when the storage is one of this package's, and otherwise verifies it
+// in one go, leaving only the pause after the file
+func (s *Scrubber) verify(fd storage.FileDesc, pace func(n int64) bool) (int64, error) {
+	if fs, ok := s.stor.(*aesgcmStorage); ok {
+		return fs.verifyPaced(fd, pace)
+	}
+	return s.stor.Verify(fd)
+}
+
+// pass verifies every file once, returning false when stopped halfway
+func (s *Scrubber) pass() bool {
+	var fds []storage.FileDesc
+	for _, ft := range []storage.FileType{storage.TypeManifest, storage.TypeJournal, storage.TypeTable} {
+		l, err := s.stor.List(ft)
+		if err != nil {
+			s.stor.Log(fmt.Sprintf("scrub: list: %v", err))
+			return err != storage.ErrClosed
+		}
+		fds = append(fds, l...)
+	}
+
+	live := make(map[storage.FileDesc]bool, len(fds))
+	rate := s.o.GetBytesPerSecond()
+	for _, fd := range fds {
+		live[fd] = true
+		start := time.Now()
+		// Paces the reads within the file, then the file as a whole below
+		var read int64
+		n, err := s.verify(fd, func(n int64) bool {
+			read += n
+			return s.wait(time.Duration(float64(read)/float64(rate)*float64(time.Second)) - time.Since(start))
+		})
+		switch {
+		case err == nil:
+			s.mu.Lock()
+			s.verified[fd] = time.Now()
+			s.mu.Unlock()
+		case os.IsNotExist(err):
+			// Removed since listed
+			live[fd] = false
+		case err == storage.ErrClosed || err == errScrubStopped:
+			return false
+		default:
+			s.stor.Log(fmt.Sprintf("scrub: %s: %v", fd, err))
+			if f := s.o.GetOnFailure(); f != nil {
+				f(fd, err)
+			}
+		}
+		if !s.wait(time.Duration(float64(n)/float64(rate)*float64(time.Second)) - time.Since(start)) {
+			return false
+		}
+	}
+
+	s.mu.Lock()
+	for fd := range s.verified {
+		if !live[fd] {
+			delete(s.verified, fd)
+		}
+	}
+	s.mu.Unlock()
+	return true
+}
@@ -0,0 +1,151 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_scrub_test.go: Background verification of every file in the storage
+ *
+ */
+
+package aesgcm
+
+import (
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScrubber(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	good := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	bad := storage.FileDesc{Type: storage.TypeTable, Num: 2}
+	journal := storage.FileDesc{Type: storage.TypeJournal, Num: 3}
+	for _, fd := range []storage.FileDesc{good, bad, journal} {
+		writeTestFile(t, fs, fd, make([]byte, 10000))
+	}
+	name := filepath.Join(temp, fsGenName(bad))
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 1
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu     sync.Mutex
+		failed []storage.FileDesc
+		done   = make(chan struct{}, 10)
+	)
+	s := StartScrubber(fs, &ScrubOptions{
+		Interval: time.Hour,
+		OnFailure: func(fd storage.FileDesc, err error) {
+			if !lerrors.IsCorrupted(err) {
+				t.Errorf("expected a corruption error, got %v", err)
+			}
+			mu.Lock()
+			failed = append(failed, fd)
+			mu.Unlock()
+			done <- struct{}{}
+		},
+	})
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("scrubber didn't report the damaged table")
+	}
+	// Wait for the rest of the pass
+	deadline := time.Now().Add(10 * time.Second)
+	for (s.LastVerified(good).IsZero() || s.LastVerified(journal).IsZero()) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failed) != 1 || failed[0] != bad {
+		t.Fatalf("expected only %s to fail, got %v", bad, failed)
+	}
+	verified := s.Verified()
+	if len(verified) != 2 || verified[good].IsZero() || verified[journal].IsZero() {
+		t.Fatalf("expected %s and %s to be verified, got %v", good, journal, verified)
+	}
+	m := fs.Metrics().Snapshot()
+	if m.VerifiedFiles != 3 || m.VerifyFailures != 1 || m.VerifiedBytes == 0 || m.OpenReaders != 0 {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+}
+
+func TestScrubber_Rate(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	for i := 0; i < 3; i++ {
+		writeTestFile(t, fs, storage.FileDesc{Type: storage.TypeTable, Num: int64(i)}, make([]byte, 10000))
+	}
+	// 10KB per second, a file per second
+	s := StartScrubber(fs, &ScrubOptions{BytesPerSecond: 10000})
+	time.Sleep(500 * time.Millisecond)
+	s.Stop()
+	if n := fs.Metrics().Snapshot().VerifiedFiles; n != 1 {
+		t.Fatalf("expected a single file verified in half a second, got %d", n)
+	}
+}
+
+func TestScrubber_RateWithinFile(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{ChunkSize: 1000})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	writeTestFile(t, fs, fd, make([]byte, 10000))
+	// A second for the file, paced chunk by chunk rather than read in one go
+	s := StartScrubber(fs, &ScrubOptions{BytesPerSecond: 10000})
+	time.Sleep(300 * time.Millisecond)
+	s.Stop()
+	if n := fs.Metrics().Snapshot().VerifiedFiles; n != 0 {
+		t.Fatalf("expected the file to still be in progress, got %d verified", n)
+	}
+	if n, err := fs.Verify(fd); err != nil || n == 0 {
+		t.Fatalf("expected the file to verify, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,103 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_trace.go: Per call tracing hooks
+ *
+ */
+
+package aesgcm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// Op identifies a traced storage call
+type Op int
+
+const (
+	OpOpen Op = iota
+	OpCreate
+	OpSync
+	OpRemove
+	OpRename
+	OpSetMeta
+	OpGetMeta
+)
+
+var opNames = []string{"Open", "Create", "Sync", "Remove", "Rename", "SetMeta", "GetMeta"}
+
+func (op Op) String() string {
+	if op >= 0 && int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// TraceEvent describes a single storage call. The same event is passed to Hooks.Start and Hooks.End, so a
+// tracer can keep its span (or anything else) in Data between the two.
+type TraceEvent struct {
+	Op Op
+	// File the call operates on. For GetMeta it is only known once the call ends.
+	Fd storage.FileDesc
+	// Target of a Rename
+	NewFd storage.FileDesc
+	// Plaintext bytes decrypted by Open, encrypted by Sync or moved by Rename
+	Bytes int64
+
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+
+	// Free for use by the hooks
+	Data interface{}
+}
+
+// Hooks are called synchronously, on the calling goroutine, around Open, Create, Sync, Remove, Rename,
+// SetMeta and GetMeta. Either callback may be nil. Calls happen concurrently, so hooks must be safe for
+// concurrent use, and they must not call back into the storage.
+type Hooks struct {
+	Start func(ev *TraceEvent)
+	End   func(ev *TraceEvent)
+}
+
+func (fs *aesgcmStorage) traceStart(op Op, fd storage.FileDesc) *TraceEvent {
+	if fs.hooks == nil {
+		return nil
+	}
+	ev := &TraceEvent{Op: op, Fd: fd, Start: time.Now()}
+	if fs.hooks.Start != nil {
+		fs.hooks.Start(ev)
+	}
+	return ev
+}
+
+func (fs *aesgcmStorage) traceEnd(ev *TraceEvent, n int64, err error) {
+	if ev == nil {
+		return
+	}
+	ev.Duration = time.Since(ev.Start)
+	ev.Bytes = n
+	ev.Err = err
+	if fs.hooks.End != nil {
+		fs.hooks.End(ev)
+	}
+}
@@ -0,0 +1,111 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_trace_test.go: Tracing hooks around storage calls
+ *
+ */
+
+package aesgcm
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestHooks_Calls(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	var (
+		mu     sync.Mutex
+		starts int
+		ends   []TraceEvent
+	)
+	hooks := &Hooks{
+		Start: func(ev *TraceEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			starts++
+			ev.Data = starts
+		},
+		End: func(ev *TraceEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			ends = append(ends, *ev)
+		},
+	}
+
+	fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{Hooks: hooks})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := storage.FileDesc{Type: storage.TypeManifest, Num: 1}
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("TEST"))
+	w.Close()
+	if err := fs.SetMeta(fd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.GetMeta(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := fs.Open(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	newfd := storage.FileDesc{Type: storage.TypeManifest, Num: 2}
+	fs.Rename(fd, newfd)
+	fs.Remove(newfd)
+	if err := fs.Remove(newfd); err == nil {
+		t.Fatal("expected error removing a missing file")
+	}
+
+	expect := []Op{OpCreate, OpSync, OpSetMeta, OpGetMeta, OpOpen, OpRename, OpRemove, OpRemove}
+	if len(ends) != len(expect) || starts != len(expect) {
+		t.Fatalf("expected %d events, got %d starts and %d ends", len(expect), starts, len(ends))
+	}
+	for i, ev := range ends {
+		if ev.Op != expect[i] {
+			t.Errorf("event %d: expected %s, got %s", i, expect[i], ev.Op)
+		}
+		if ev.Data != i+1 {
+			t.Errorf("event %d: data from Start not passed to End", i)
+		}
+	}
+	if ends[1].Bytes != 4 || ends[4].Bytes != 4 {
+		t.Errorf("expected 4 bytes for Sync and Open, got %d and %d", ends[1].Bytes, ends[4].Bytes)
+	}
+	if ends[3].Fd != fd {
+		t.Errorf("expected GetMeta to report %s, got %s", fd, ends[3].Fd)
+	}
+	if ends[5].NewFd != newfd {
+		t.Errorf("expected Rename target %s, got %s", newfd, ends[5].NewFd)
+	}
+	if ends[6].Err != nil || ends[7].Err == nil {
+		t.Errorf("expected only the second Remove to fail, got %v and %v", ends[6].Err, ends[7].Err)
+	}
+}
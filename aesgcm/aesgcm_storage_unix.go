@@ -18,17 +18,21 @@ import (
 )
 
 type unixFileLock struct {
-	f *os.File
+	f        *os.File
+	readOnly bool
 }
 
 func (fl *unixFileLock) release() error {
+	if !fl.readOnly {
+		fl.f.Truncate(0)
+	}
 	if err := setFileLock(fl.f, false, false); err != nil {
 		return err
 	}
 	return fl.f.Close()
 }
 
-func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
+func newFileLock(path string, perm os.FileMode, readOnly bool) (fl fileLock, err error) {
 	var flag int
 	if readOnly {
 		flag = os.O_RDONLY
@@ -37,7 +41,7 @@ func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 	}
 	f, err := os.OpenFile(path, flag, 0)
 	if os.IsNotExist(err) {
-		f, err = os.OpenFile(path, flag|os.O_CREATE, 0644)
+		f, err = os.OpenFile(path, flag|os.O_CREATE, perm)
 	}
 	if err != nil {
 		return
@@ -47,10 +51,26 @@ func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 		f.Close()
 		return
 	}
-	fl = &unixFileLock{f: f}
+	if !readOnly {
+		tightenMode(f, perm)
+		writeLockHolder(f)
+	}
+	fl = &unixFileLock{f: f, readOnly: readOnly}
 	return
 }
 
+// tightenMode clears the permission bits of f that perm lacks, so a LOCK file created under a looser
+// FileMode follows a later, stricter one. Failing to, e.g. when owned by another user, is not an error.
+func tightenMode(f *os.File, perm os.FileMode) {
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if mode := fi.Mode().Perm(); mode&^perm != 0 {
+		f.Chmod(mode & perm)
+	}
+}
+
 func setFileLock(f *os.File, readOnly, lock bool) error {
 	how := syscall.LOCK_UN
 	if lock {
@@ -63,6 +83,18 @@ func setFileLock(f *os.File, readOnly, lock bool) error {
 	return syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
 }
 
+// isLockBusy tells whether newFileLock failed because another process holds the lock
+func isLockBusy(err error) bool {
+	return err == syscall.EWOULDBLOCK || err == syscall.EAGAIN
+}
+
+// processRunning tells whether a process with the given PID runs on this host, and whether that could be
+// told at all
+func processRunning(pid int) (running, known bool) {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM, true
+}
+
 func rename(oldpath, newpath string) error {
 	return os.Rename(oldpath, newpath)
 }
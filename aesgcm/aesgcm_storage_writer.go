@@ -24,43 +24,195 @@
 package aesgcm
 
 import (
-	"bytes"
-	"crypto/rand"
 	"fmt"
 	"github.com/syndtr/goleveldb/leveldb/storage"
+	"hash/crc32"
 	"os"
+	"sync"
+	"time"
 )
 
+// aesgcmWriter streams a file to disk chunk by chunk. Plaintext collects in a pooled buffer; once the
+// buffer holds the configured limit, its full chunks are sealed and appended to the file. Sync seals
+// whatever is left, marking the last chunk as a commit point, and Close does the same with the final
+// chunk. Nothing already on disk is ever rewritten, so a crash can only lose what was written after the
+// last Sync. The buffer is wiped and returned to the pool on Close.
+//
+// The file is created under its pending name and only renamed to its own once durable: journals and
+// manifests at their first Sync, tables and temporary files, which are useless until complete, at Close.
+// Readers thus never see a file that is empty, or a table that is half written, and any previous file of
+// the same name stays readable until replaced.
+//
+// With Options.VerifyWrites, the writer keeps a checksum of the plaintext of every chunk it seals, and
+// before each commit returns reads back the chunks written since the last one and checks they decrypt to
+// the same.
 type aesgcmWriter struct {
-	*bytes.Buffer
+	// Held by Write, Sync and Close, so SetMeta and Checkpoint can commit the writer from another goroutine
+	mu     sync.Mutex
 	fs     *aesgcmStorage
 	fd     storage.FileDesc
 	closed bool
 	fp     *os.File
+	handle *Handle
+
+	pending   []byte // plaintext not sealed yet
+	limit     int    // flush once pending reaches this, a multiple of the chunk size
+	chunkSize int
+	index     uint64 // of the next chunk
+	started   bool   // header written
+	dirty     bool   // chunks written since the last commit point
+	published bool   // renamed from the pending name
+	internal  bool   // written by the storage itself, inside another traced call
+	err       error  // sticky, the file is in an unknown state after a failed write
+
+	// Only kept with VerifyWrites
+	written  int64    // bytes appended to the file
+	verified int64    // bytes of it read back and checked
+	sums     []uint32 // plaintext checksums of the chunks after verified
 }
 
 func newWriter(fp *os.File, fd storage.FileDesc, fs *aesgcmStorage) *aesgcmWriter {
-	return &aesgcmWriter{
-		Buffer: new(bytes.Buffer),
-		fs:     fs,
-		fd:     fd,
-		closed: false,
-		fp:     fp,
+	chunkSize := fs.chunkSize
+	limit := fs.writeBuffer / chunkSize * chunkSize
+	if limit < chunkSize {
+		limit = chunkSize
+	}
+	w := &aesgcmWriter{
+		fs:        fs,
+		fd:        fd,
+		closed:    false,
+		fp:        fp,
+		handle:    fs.handles.add(fd, true),
+		pending:   getBuffer(0),
+		limit:     limit,
+		chunkSize: chunkSize,
+	}
+	fs.mu.Lock()
+	fs.writers[w] = struct{}{}
+	fs.mu.Unlock()
+	return w
+}
+
+func (w *aesgcmWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, storage.ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := w.limit - len(w.pending)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.pending = growBuffer(w.pending, n)
+		w.pending = append(w.pending, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.pending) == w.limit {
+			if _, err := w.flush(len(w.pending), 0); err != nil {
+				return written, err
+			}
+		}
 	}
+	return written, nil
+}
+
+// flush seals the first n bytes of pending, which must be a multiple of the chunk size unless flags is
+// set, appends them to the file and moves the rest of pending to the front. With flags set, the last
+// chunk written carries them even if it is empty. Returns the number of plaintext bytes sealed.
+func (w *aesgcmWriter) flush(n int, flags byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if !w.started {
+		hdr, err := w.fs.sealHeader(w.fd, w.chunkSize)
+		if err != nil {
+			return 0, err
+		}
+		_, err = w.fp.Write(hdr)
+		w.written += int64(len(hdr))
+		putBuffer(hdr)
+		if err != nil {
+			w.fs.Log(fmt.Sprintf("write %s: %v", w.fd, err))
+			w.err = err
+			return 0, err
+		}
+		w.started = true
+	}
+
+	chunks := (n + w.chunkSize - 1) / w.chunkSize
+	if flags != 0 && chunks == 0 {
+		chunks = 1
+	}
+	if chunks == 0 {
+		return 0, nil
+	}
+	first := w.index
+	var sums []uint32
+	if w.fs.verifyWrites {
+		sums = make([]uint32, chunks)
+	}
+	err := runPipeline(w.fs.concurrency, chunks, func(i int) ([]byte, error) {
+		end := (i + 1) * w.chunkSize
+		var f byte
+		if i == chunks-1 {
+			end = n
+			f = flags
+		}
+		if sums != nil {
+			sums[i] = crc32.Checksum(w.pending[i*w.chunkSize:end], crcTable)
+		}
+		return w.fs.sealChunk(w.fd, first+uint64(i), f, w.pending[i*w.chunkSize:end])
+	}, func(i int, chunk []byte) error {
+		_, err := w.fp.Write(chunk)
+		w.written += int64(len(chunk))
+		putBuffer(chunk)
+		return err
+	})
+	if err != nil {
+		w.fs.Log(fmt.Sprintf("write %s: %v", w.fd, err))
+		w.err = err
+		return 0, err
+	}
+	w.index += uint64(chunks)
+	w.dirty = flags == 0
+	w.sums = append(w.sums, sums...)
+
+	rest := copy(w.pending, w.pending[n:])
+	wipe(w.pending[rest:])
+	w.pending = w.pending[:rest]
+	return n, nil
 }
 
 func (w *aesgcmWriter) Close() error {
-	err := w.Sync()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return w.fs.doubleClose(w.handle)
+	}
+	err := w.commit(chunkFinal)
 	if err != nil {
 		return err
 	}
 	w.fs.mu.Lock()
-	defer w.fs.mu.Unlock()
 	if w.closed {
-		return storage.ErrClosed
+		w.fs.mu.Unlock()
+		return w.fs.doubleClose(w.handle)
 	}
 	w.closed = true
-	w.fs.open--
+	delete(w.fs.writers, w)
+	w.fs.mu.Unlock()
+
+	w.fs.handles.remove(w.handle)
+	putBuffer(w.pending)
+	w.pending = nil
+	w.fs.syncer.remove(w)
+	w.fs.release()
+	w.fs.metrics.writerOpened(-1)
 	err = w.fp.Close()
 	if err != nil {
 		w.fs.Log(fmt.Sprintf("close %s: %v", w.fd, err))
@@ -68,55 +220,168 @@ func (w *aesgcmWriter) Close() error {
 	return err
 }
 
+// abort releases a writer whose Close failed, without writing anything more
+func (w *aesgcmWriter) abort() {
+	w.fs.mu.Lock()
+	if w.closed {
+		w.fs.mu.Unlock()
+		return
+	}
+	w.closed = true
+	delete(w.fs.writers, w)
+	w.fs.mu.Unlock()
+
+	w.fs.handles.remove(w.handle)
+	putBuffer(w.pending)
+	w.pending = nil
+	w.fs.syncer.remove(w)
+	w.fs.release()
+	w.fs.metrics.writerOpened(-1)
+	w.fp.Close()
+}
+
 func (w *aesgcmWriter) Sync() error {
-	if err := w.fp.Truncate(0); err != nil {
-		w.fs.Log(fmt.Sprintf("truncate %s: %v", w.fd, err))
-		return err
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return storage.ErrClosed
+	}
+	return w.commit(chunkCommit)
+}
+
+// commit seals everything pending with flags on the last chunk, then makes it as durable as the storage's
+// durability mode asks for
+func (w *aesgcmWriter) commit(flags byte) (err error) {
+	var ev *TraceEvent
+	if !w.internal {
+		ev = w.fs.traceStart(OpSync, w.fd)
 	}
+	var sealed int
+	defer func() { w.fs.traceEnd(ev, int64(sealed), err) }()
 
-	if _, err := w.fp.Seek(0, 0); err != nil {
-		w.fs.Log(fmt.Sprintf("seek %s: %v", w.fd, err))
-		return err
+	if len(w.pending) > 0 || w.dirty || !w.started || flags == chunkFinal {
+		if sealed, err = w.flush(len(w.pending), flags); err != nil {
+			return err
+		}
+	}
+	if w.fs.verifyWrites {
+		if err = w.verify(); err != nil {
+			return err
+		}
 	}
 
-	nonce := make([]byte, w.fs.cyp.NonceSize())
+	if w.fs.syncer != nil && w.fd.Type == storage.TypeJournal && flags != chunkFinal {
+		// Written out, the syncer fsyncs it with the next batch
+		w.fs.syncer.add(w)
+	} else {
+		start := time.Now()
+		err = w.fp.Sync()
+		w.fs.metrics.synced(time.Since(start))
+		if err != nil {
+			w.fs.Log(fmt.Sprintf("sync %s: %v", w.fd, err))
+			return err
+		}
+	}
 
-	read, err := rand.Read(nonce)
-	if err != nil {
-		return err
+	if !w.published && (flags == chunkFinal || !requiresFinal(w.fd)) {
+		return w.publish()
 	}
-	if read != w.fs.cyp.NonceSize() {
-		return errNonceUnavailable
+
+	if w.fd.Type == storage.TypeManifest || w.fs.durability == DurabilityStrict {
+		// Also sync parent directory if file type is manifest, or of every file in strict mode.
+		// See: https://code.google.com/p/leveldb/issues/detail?id=190.
+		start := time.Now()
+		err := w.fs.dir.sync()
+		w.fs.metrics.synced(time.Since(start))
+		if err != nil {
+			w.fs.Log(fmt.Sprintf("syncDir: %v", err))
+			return err
+		}
 	}
 
-	crypt := w.fs.cyp.Seal(nil, nonce, w.Buffer.Bytes(), fdGenAD(w.fd))
+	return nil
+}
 
-	_, err = w.fp.Write(nonce)
-	if err != nil {
-		w.fs.Log(fmt.Sprintf("write %s: %v", w.fd, err))
+// publish renames the synced pending file to its own name and syncs the directory, so the rename itself
+// survives a crash
+func (w *aesgcmWriter) publish() error {
+	if err := w.fs.dir.rename(fsGenPendingName(w.fd), fsGenName(w.fd)); err != nil {
+		w.fs.Log(fmt.Sprintf("publish %s: %v", w.fd, err))
 		return err
 	}
-
-	_, err = w.fp.Write(crypt)
+	w.published = true
+	start := time.Now()
+	err := w.fs.dir.sync()
+	w.fs.metrics.synced(time.Since(start))
 	if err != nil {
-		w.fs.Log(fmt.Sprintf("write %s: %v", w.fd, err))
+		w.fs.Log(fmt.Sprintf("syncDir: %v", err))
 		return err
 	}
+	return nil
+}
 
-	err = w.fp.Sync()
-	if err != nil {
-		w.fs.Log(fmt.Sprintf("sync %s: %v", w.fd, err))
-		return err
+// verify reads back everything written since the last verification, a chunk at a time, and checks that the
+// header authenticates and every chunk decrypts to the plaintext that was sealed into it
+func (w *aesgcmWriter) verify() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.verified == w.written {
+		return nil
 	}
 
-	if w.fd.Type == storage.TypeManifest {
-		// Also sync parent directory if file type is manifest.
-		// See: https://code.google.com/p/leveldb/issues/detail?id=190.
-		if err := syncDir(w.fs.path); err != nil {
-			w.fs.Log(fmt.Sprintf("syncDir: %v", err))
-			return err
+	off := w.verified
+	if off == 0 {
+		h := getBuffer(headerLen(formatVersion))
+		defer putBuffer(h)
+		if _, err := w.fp.ReadAt(h, 0); err != nil {
+			return w.verifyFailed(err)
+		}
+		if _, _, err := w.fs.openHeader(w.fd, h); err != nil {
+			return w.verifyFailed(err)
 		}
+		off = int64(len(h))
 	}
-
+	// The chunks before these were verified before
+	first := w.index - uint64(len(w.sums))
+	buf := getBuffer(chunkOverhead(formatVersion) + w.chunkSize)
+	defer putBuffer(buf)
+	plain := getBuffer(w.chunkSize)
+	defer putBuffer(plain)
+	for i, sum := range w.sums {
+		n := len(buf)
+		if rest := w.written - off; rest < int64(n) {
+			n = int(rest)
+		}
+		if _, err := w.fp.ReadAt(buf[:n], off); err != nil {
+			return w.verifyFailed(err)
+		}
+		ref, err := parseChunk(buf[:n], 0, w.chunkSize, formatVersion)
+		if err != nil {
+			return w.verifyFailed(err)
+		}
+		ref.index = first + uint64(i)
+		p := plain[:ref.sealed-gcmTagSize]
+		if err := w.fs.openChunk(w.fd, buf[:n], &ref, formatVersion, p); err != nil {
+			return w.verifyFailed(err)
+		}
+		ok := crc32.Checksum(p, crcTable) == sum
+		wipe(p)
+		if !ok {
+			return w.verifyFailed(fmt.Errorf("chunk %d decrypts to other data than was sealed", ref.index))
+		}
+		off += int64(ref.end(formatVersion))
+	}
+	if off != w.written {
+		return w.verifyFailed(errTrailingBytes)
+	}
+	w.verified = w.written
+	w.sums = w.sums[:0]
 	return nil
 }
+
+func (w *aesgcmWriter) verifyFailed(cause error) error {
+	w.fs.Log(fmt.Sprintf("verify %s: %v", w.fd, cause))
+	w.err = fmt.Errorf("%w: %s: %v", ErrWriteVerify, w.fd, cause)
+	return w.err
+}
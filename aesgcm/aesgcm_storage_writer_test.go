@@ -0,0 +1,429 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * aesgcm_storage_writer_test.go: Streaming writer, commit points and truncated files
+ *
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriter_Streams(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{WriteBufferSize: 2 * defaultChunkSize})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: 1}
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 10*defaultChunkSize+3)
+	rand.Read(data)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// Everything but the last partial buffer is on disk before Close
+	fi, err := os.Stat(filepath.Join(temp, fsGenPendingName(fd)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() < int64(10*defaultChunkSize) {
+		t.Fatalf("expected at least %d bytes written before close, got %d", 10*defaultChunkSize, fi.Size())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readTestFile(fs, fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("contents differ")
+	}
+}
+
+func TestWriter_SyncThenWrite(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := storage.FileDesc{Type: storage.TypeJournal, Num: 1}
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for i := 0; i < 5; i++ {
+		part := make([]byte, 1000*(i+1))
+		rand.Read(part)
+		data = append(data, part...)
+		if _, err := w.Write(part); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		// Syncing twice adds nothing
+		if err := w.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readTestFile(fs, fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("contents differ")
+	}
+}
+
+func TestWriter_Truncated(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	synced := make([]byte, 3000)
+	rand.Read(synced)
+	unsynced := make([]byte, 2*defaultChunkSize)
+	rand.Read(unsynced)
+
+	for _, ft := range []storage.FileType{storage.TypeJournal, storage.TypeManifest, storage.TypeTable} {
+		fd := storage.FileDesc{Type: ft, Num: 2}
+		w, err := fs.Create(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(synced); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(unsynced); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Cut the file in the middle of the chunks written after the Sync, as a crash would
+		path := filepath.Join(temp, fsGenName(fd))
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(path, fi.Size()-defaultChunkSize); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := readTestFile(fs, fd)
+		if ft == storage.TypeTable {
+			if err == nil {
+				t.Fatal("expected an error reading a truncated table")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", fd, err)
+		}
+		if !bytes.Equal(got, synced) {
+			t.Fatalf("%s: expected the synced contents, got %d bytes", fd, len(got))
+		}
+	}
+}
+
+func TestWriter_CorruptedNotTorn(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	for _, ft := range []storage.FileType{storage.TypeJournal, storage.TypeManifest} {
+		fd := storage.FileDesc{Type: ft, Num: 2}
+		path := filepath.Join(temp, fsGenName(fd))
+		w, err := fs.Create(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var open []byte
+		for i := 0; i < 2; i++ {
+			if _, err := w.Write(make([]byte, 3000)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// As left by a crash: committed chunks only, no final chunk
+		if open, err = ioutil.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		closed, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// An impossible length in the first chunk is damage, not a torn tail
+		for name, b := range map[string][]byte{"closed": closed, "open": open} {
+			copy(b[headerLen(formatVersion)+1:], []byte{0xff, 0xff, 0xff, 0xff})
+			if err := ioutil.WriteFile(path, b, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readTestFile(fs, fd); !isCorrupted(err) {
+				t.Fatalf("%s %s: expected a corruption error, got %v", name, fd, err)
+			}
+		}
+	}
+}
+
+func TestWriter_Empty(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	// A journal created but never written to or synced, as after a crash
+	fd := storage.FileDesc{Type: storage.TypeJournal, Num: 3}
+	if err := ioutil.WriteFile(filepath.Join(temp, fsGenName(fd)), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readTestFile(fs, fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected an empty journal, got %d bytes", len(got))
+	}
+}
+
+func TestWriter_Publish(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+
+	old := []byte("previous version")
+	table := storage.FileDesc{Type: storage.TypeTable, Num: 4}
+	writeTestFile(t, fs, table, old)
+
+	// Rewriting the table leaves the previous version readable until Close, even after a Sync
+	w, err := fs.Create(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("new version")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readTestFile(fs, table); err != nil || !bytes.Equal(got, old) {
+		t.Fatalf("expected the previous version before close, got %q, %v", got, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readTestFile(fs, table); err != nil || string(got) != "new version" {
+		t.Fatalf("expected the new version after close, got %q, %v", got, err)
+	}
+
+	// A journal appears at its first Sync
+	journal := storage.FileDesc{Type: storage.TypeJournal, Num: 5}
+	w, err = fs.Create(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(temp, fsGenName(journal))); !os.IsNotExist(err) {
+		t.Fatalf("expected no journal before sync, got %v", err)
+	}
+	if fds, err := fs.List(storage.TypeJournal); err != nil || len(fds) != 0 {
+		t.Fatalf("expected pending journal to be unlisted, got %v, %v", fds, err)
+	}
+	if _, err := w.Write([]byte("record")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readTestFile(fs, journal); err != nil || string(got) != "record" {
+		t.Fatalf("expected the synced journal, got %q, %v", got, err)
+	}
+
+	// Left pending by a crash, a table is removed on the next open
+	crashed := storage.FileDesc{Type: storage.TypeTable, Num: 6}
+	if w, err = fs.Create(crashed); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+	fs, err = OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+	if _, err := os.Stat(filepath.Join(temp, fsGenPendingName(crashed))); !os.IsNotExist(err) {
+		t.Fatalf("expected the pending table to be removed, got %v", err)
+	}
+	if got, err := readTestFile(fs, journal); err != nil || string(got) != "record" {
+		t.Fatalf("expected the journal to survive, got %q, %v", got, err)
+	}
+}
+
+func TestWriter_Rename(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFile(temp, testKey, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	data := make([]byte, 2*defaultChunkSize+5)
+	rand.Read(data)
+	tmp := storage.FileDesc{Type: storage.TypeTemp, Num: 7}
+	table := storage.FileDesc{Type: storage.TypeTable, Num: 3}
+	writeTestFile(t, fs, tmp, data)
+	writeTestFile(t, fs, table, []byte("replaced"))
+
+	if err := fs.Rename(tmp, table); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readTestFile(fs, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("contents differ after rename")
+	}
+	if _, err := os.Stat(filepath.Join(temp, fsGenName(tmp))); !os.IsNotExist(err) {
+		t.Fatalf("expected the old file to be gone, got %v", err)
+	}
+	if n := fs.Metrics().Snapshot().OpenWriters; n != 0 {
+		t.Fatalf("expected no open writers, got %d", n)
+	}
+}
+
+func TestWriter_VerifyWrites(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenEncryptedFileWithOptions(temp, testKey, &Options{WriteBufferSize: defaultChunkSize, VerifyWrites: true})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	// Intact writes pass, across several commits
+	good := storage.FileDesc{Type: storage.TypeJournal, Num: 1}
+	w, err := fs.Create(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3*defaultChunkSize+100)
+	rand.Read(data)
+	for _, part := range [][]byte{data[:100], data[100 : 2*defaultChunkSize], data[2*defaultChunkSize:]} {
+		if _, err := w.Write(part); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readTestFile(fs, good); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected the data back, got %d bytes and %v", len(got), err)
+	}
+
+	// Damage to chunks streamed out by Write is found by the next Sync
+	bad := storage.FileDesc{Type: storage.TypeJournal, Num: 2}
+	w, err = fs.Create(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data[:2*defaultChunkSize]); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(temp, fsGenPendingName(bad))
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := int64(headerLen(formatVersion) + chunkOverhead(formatVersion) + 100)
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{b[off] ^ 1}, off)
+	f.Close()
+
+	if err := w.Sync(); !errors.Is(err, ErrWriteVerify) {
+		t.Fatalf("expected the Sync to fail verification, got %v", err)
+	}
+	if _, err := w.Write([]byte("more")); !errors.Is(err, ErrWriteVerify) {
+		t.Fatalf("expected the writer to stay failed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(temp, fsGenName(bad))); !os.IsNotExist(err) {
+		t.Fatalf("expected the damaged journal not to be published, got %v", err)
+	}
+}
@@ -17,7 +17,7 @@ import (
 	"syscall"
 )
 
-func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
+func newFileLock(path string, perm os.FileMode, readOnly bool) (fl fileLock, err error) {
 	return nil, syscall.ENOTSUP
 }
 
@@ -25,6 +25,15 @@ func setFileLock(f *os.File, readOnly, lock bool) error {
 	return syscall.ENOTSUP
 }
 
+// isLockBusy is never true, locking isn't supported at all
+func isLockBusy(err error) bool {
+	return false
+}
+
+func processRunning(pid int) (running, known bool) {
+	return false, false
+}
+
 func rename(oldpath, newpath string) error {
 	return syscall.ENOTSUP
 }
@@ -22,20 +22,20 @@ func (fl *plan9FileLock) release() error {
 	return fl.f.Close()
 }
 
-func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
+func newFileLock(path string, perm os.FileMode, readOnly bool) (fl fileLock, err error) {
 	var (
 		flag int
-		perm os.FileMode
+		mode os.FileMode
 	)
 	if readOnly {
 		flag = os.O_RDONLY
 	} else {
 		flag = os.O_RDWR
-		perm = os.ModeExclusive
+		mode = os.ModeExclusive
 	}
-	f, err := os.OpenFile(path, flag, perm)
+	f, err := os.OpenFile(path, flag, mode)
 	if os.IsNotExist(err) {
-		f, err = os.OpenFile(path, flag|os.O_CREATE, perm|0644)
+		f, err = os.OpenFile(path, flag|os.O_CREATE, mode|perm)
 	}
 	if err != nil {
 		return
@@ -44,6 +44,17 @@ func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 	return
 }
 
+// isLockBusy can't tell a file held exclusively by another process apart from other failures to open it,
+// so opening never waits for the lock on Plan 9
+func isLockBusy(err error) bool {
+	return false
+}
+
+// processRunning can't tell whether the holder runs: the LOCK file records no holder on Plan 9
+func processRunning(pid int) (running, known bool) {
+	return false, false
+}
+
 func rename(oldpath, newpath string) error {
 	if _, err := os.Stat(newpath); err == nil {
 		if err := os.Remove(newpath); err != nil {
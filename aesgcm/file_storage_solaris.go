@@ -28,7 +28,7 @@ func (fl *unixFileLock) release() error {
 	return fl.f.Close()
 }
 
-func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
+func newFileLock(path string, perm os.FileMode, readOnly bool) (fl fileLock, err error) {
 	var flag int
 	if readOnly {
 		flag = os.O_RDONLY
@@ -37,7 +37,7 @@ func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 	}
 	f, err := os.OpenFile(path, flag, 0)
 	if os.IsNotExist(err) {
-		f, err = os.OpenFile(path, flag|os.O_CREATE, 0644)
+		f, err = os.OpenFile(path, flag|os.O_CREATE, perm)
 	}
 	if err != nil {
 		return
@@ -68,6 +68,16 @@ func setFileLock(f *os.File, readOnly, lock bool) error {
 	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &flock)
 }
 
+// isLockBusy tells whether newFileLock failed because another process holds the lock
+func isLockBusy(err error) bool {
+	return err == syscall.EAGAIN || err == syscall.EACCES
+}
+
+func processRunning(pid int) (running, known bool) {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM, true
+}
+
 func rename(oldpath, newpath string) error {
 	return os.Rename(oldpath, newpath)
 }
@@ -11,6 +11,7 @@
 package storage
 
 import (
+	"os"
 	"syscall"
 	"unsafe"
 )
@@ -23,6 +24,8 @@ var (
 
 const (
 	_MOVEFILE_REPLACE_EXISTING = 1
+
+	_ERROR_SHARING_VIOLATION syscall.Errno = 32
 )
 
 type windowsFileLock struct {
@@ -33,7 +36,7 @@ func (fl *windowsFileLock) release() error {
 	return syscall.Close(fl.fd)
 }
 
-func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
+func newFileLock(path string, perm os.FileMode, readOnly bool) (fl fileLock, err error) {
 	pathp, err := syscall.UTF16PtrFromString(path)
 	if err != nil {
 		return
@@ -56,6 +59,16 @@ func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 	return
 }
 
+// isLockBusy tells whether newFileLock failed because another process has the file open
+func isLockBusy(err error) bool {
+	return err == _ERROR_SHARING_VIOLATION
+}
+
+// processRunning can't tell whether the holder runs: the LOCK file records no holder on Windows
+func processRunning(pid int) (running, known bool) {
+	return false, false
+}
+
 func moveFileEx(from *uint16, to *uint16, flags uint32) error {
 	r1, _, e1 := syscall.Syscall(procMoveFileExW.Addr(), 3, uintptr(unsafe.Pointer(from)), uintptr(unsafe.Pointer(to)), uintptr(flags))
 	if r1 == 0 {
@@ -0,0 +1,148 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * main.go: Maintenance commands for encrypted databases
+ */
+
+// Command encryptedldb runs maintenance tasks on databases stored with goleveldb-encrypted.
+//
+// Usage:
+//
+//	encryptedldb salvage -keyfile KEY SRC DST
+//	encryptedldb verify DIR
+//
+// verify checks the checksums of every file without the key, and exits with status 1 if any is damaged.
+// The key file holds the raw 16, 24 or 32 byte key, or the same in hex.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	encrypted "github.com/tenta-browser/goleveldb-encrypted"
+	"github.com/tenta-browser/goleveldb-encrypted/aesgcm"
+)
+
+var commands = map[string]func(args []string) error{
+	"salvage": salvage,
+	"verify":  verify,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: encryptedldb salvage -keyfile KEY SRC DST")
+		fmt.Fprintln(os.Stderr, "       encryptedldb verify DIR")
+		os.Exit(2)
+	}
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "encryptedldb:", err)
+		os.Exit(1)
+	}
+}
+
+func readKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no key file given")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if text := strings.TrimSpace(string(b)); len(text) == 32 || len(text) == 48 || len(text) == 64 {
+		if key, err := hex.DecodeString(text); err == nil {
+			return key, nil
+		}
+	}
+	return b, nil
+}
+
+func salvage(args []string) error {
+	fl := flag.NewFlagSet("salvage", flag.ExitOnError)
+	keyFile := fl.String("keyfile", "", "file holding the database key")
+	fl.Usage = func() {
+		fmt.Fprintln(fl.Output(), "usage: encryptedldb salvage -keyfile KEY SRC DST")
+		fmt.Fprintln(fl.Output(), "Copies every readable record of the database at SRC into a new database at DST.")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	if fl.NArg() != 2 {
+		fl.Usage()
+		os.Exit(2)
+	}
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	report, err := encrypted.SalvageAESEncryptedFile(fl.Arg(0), fl.Arg(1), key)
+	if err != nil {
+		return err
+	}
+	for _, f := range report.Files {
+		status := "ok"
+		if f.Err != nil {
+			status = f.Err.Error()
+		}
+		fmt.Printf("%s\trecords %d\tcorrupted blocks %d\tdropped bytes %d\tdamaged bytes %d\tlost bytes %d\t%s\n",
+			f.Fd, f.Records, f.CorruptedBlocks, f.DroppedBytes, f.DamagedBytes, f.LostBytes, status)
+	}
+	fmt.Printf("salvaged %d keys, %d deleted, up to sequence %d; %d of %d files damaged\n",
+		report.Keys, report.Deleted, report.MaxSeq, len(report.Lost()), len(report.Files))
+	return nil
+}
+
+func verify(args []string) error {
+	fl := flag.NewFlagSet("verify", flag.ExitOnError)
+	fl.Usage = func() {
+		fmt.Fprintln(fl.Output(), "usage: encryptedldb verify DIR")
+		fmt.Fprintln(fl.Output(), "Checks the checksums of every file of the database at DIR, without the key.")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	if fl.NArg() != 1 {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	reports, err := aesgcm.VerifyChecksums(fl.Arg(0))
+	if err != nil {
+		return err
+	}
+	damaged := 0
+	for _, r := range reports {
+		status := "ok"
+		switch {
+		case r.Err != nil:
+			status = r.Err.Error()
+			damaged++
+		case r.Unverifiable:
+			status = "no checksums"
+		}
+		fmt.Printf("%s\tsize %d\tchunks %d\ttorn bytes %d\t%s\n", r.Fd, r.Size, r.Chunks, r.TornBytes, status)
+	}
+	fmt.Printf("%d of %d files damaged\n", damaged, len(reports))
+	if damaged > 0 {
+		return fmt.Errorf("%d damaged files", damaged)
+	}
+	return nil
+}
@@ -23,7 +23,8 @@
 package goleveldb_encrypted
 
 import (
-	"io"
+	"context"
+	"sync"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
@@ -32,27 +33,110 @@ import (
 
 type EncryptedDB struct {
 	*leveldb.DB
-	scloser io.Closer
+	stor aesgcm.Storage
+	// goleveldb options of a secondary database, nil otherwise
+	secondary *opt.Options
+	// Held by every call into DB, and exclusively by Refresh to replace it
+	swap sync.RWMutex
+	// The iterators open on DB, for a secondary database
+	ref *dbRef
+
+	mu       sync.Mutex
+	scrubber *aesgcm.Scrubber
+}
+
+// Close closes the database, then its storage. It returns the database's error if closing it failed, and
+// otherwise the storage's, e.g. an *aesgcm.LeakError naming the readers and writers left open.
+func (e *EncryptedDB) Close() error {
+	e.StopScrubber()
+	e.swap.Lock()
+	err := e.DB.Close()
+	e.swap.Unlock()
+	if serr := e.stor.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// StartScrubber starts verifying every file of the database in the background, replacing the scrubber
+// already running if any. It is stopped by StopScrubber or Close. Its results are counted in
+// StorageMetrics and passed to o.OnFailure.
+func (e *EncryptedDB) StartScrubber(o *aesgcm.ScrubOptions) *aesgcm.Scrubber {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.scrubber != nil {
+		e.scrubber.Stop()
+	}
+	e.scrubber = aesgcm.StartScrubber(e.stor, o)
+	return e.scrubber
+}
+
+// StopScrubber stops the scrubber started by StartScrubber, if any
+func (e *EncryptedDB) StopScrubber() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.scrubber != nil {
+		e.scrubber.Stop()
+		e.scrubber = nil
+	}
 }
 
-func (e *EncryptedDB) Close() {
-	e.DB.Close()
-	e.scloser.Close()
+// StorageMetrics returns the collector recording the cost of the encryption layer under this database
+func (e *EncryptedDB) StorageMetrics() *aesgcm.Metrics {
+	return e.stor.Metrics()
 }
 
+// OpenAESEncryptedFile is the encrypted equivalent of leveldb.OpenFile
 func OpenAESEncryptedFile(path string, key []byte, opt *opt.Options) (db *EncryptedDB, err error) {
-	stor, err := aesgcm.OpenEncryptedFile(path, key, opt.GetReadOnly())
+	return OpenAESEncryptedFileWithOptions(path, key, opt, nil)
+}
+
+// OpenAESEncryptedFileWithOptions is OpenAESEncryptedFile with the optional parameters of the encrypted
+// storage in sopt, which may be nil. The storage is read-only if either option set asks for it.
+func OpenAESEncryptedFileWithOptions(path string, key []byte, opt *opt.Options, sopt *aesgcm.Options) (db *EncryptedDB, err error) {
+	stor, err := aesgcm.OpenEncryptedFileWithOptions(path, key, storageOptions(opt, sopt))
 	if err != nil {
 		return
 	}
+	return openDB(stor, opt)
+}
+
+// OpenAESEncryptedFileContext is OpenAESEncryptedFileWithOptions, except that while another process has the
+// database open it waits for it to close it, until ctx is done. The *aesgcm.LockError returned then names
+// the process holding the database.
+func OpenAESEncryptedFileContext(ctx context.Context, path string, key []byte, opt *opt.Options, sopt *aesgcm.Options) (db *EncryptedDB, err error) {
+	stor, err := aesgcm.OpenEncryptedFileContext(ctx, path, key, storageOptions(opt, sopt))
+	if err != nil {
+		return
+	}
+	return openDB(stor, opt)
+}
+
+// storageOptions copies sopt, making the storage read-only if either option set asks for it
+func storageOptions(opt *opt.Options, sopt *aesgcm.Options) *aesgcm.Options {
+	so := aesgcm.Options{}
+	if sopt != nil {
+		so = *sopt
+	}
+	so.ReadOnly = so.ReadOnly || opt.GetReadOnly()
+	return &so
+}
+
+func openDB(stor aesgcm.Storage, opt *opt.Options) (db *EncryptedDB, err error) {
 	ldb, err := leveldb.Open(stor, opt)
 	if err != nil {
 		stor.Close()
 	} else {
 		db = &EncryptedDB{
-			DB:      ldb,
-			scloser: stor,
+			DB:   ldb,
+			stor: stor,
 		}
 	}
 	return
 }
+
+// Checkpoint makes a point-in-time copy of the database in dir, which must not exist yet, that opens with
+// the same key as a database of its own. Tables are hard-linked where possible, so it is cheap.
+func (e *EncryptedDB) Checkpoint(dir string) error {
+	return e.stor.Checkpoint(dir)
+}
@@ -26,13 +26,20 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha512"
+	"errors"
 	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tenta-browser/goleveldb-encrypted/aesgcm"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
 	"testing"
+	"time"
 )
 
 var testKey = []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, 0x9, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf}
@@ -201,3 +208,168 @@ func TestOpenAESEncryptedFile_Fuzz(t *testing.T) {
 
 	os.RemoveAll(d)
 }
+
+func TestEncryptedDB_Scrubber(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+
+	db, e := OpenAESEncryptedFile(d, testKey, nil)
+	if e != nil {
+		t.Fatalf("Could not create DB: %s", e.Error())
+	}
+	// Synced, so the journal is published
+	for _, i := range basicTestData {
+		if e := db.Put([]byte(i.key), []byte(i.value), &opt.WriteOptions{Sync: true}); e != nil {
+			t.Fatalf("Put: %s", e.Error())
+		}
+	}
+
+	failures := 0
+	s := db.StartScrubber(&aesgcm.ScrubOptions{OnFailure: func(fd storage.FileDesc, err error) { failures++ }})
+	deadline := time.Now().Add(10 * time.Second)
+	for len(s.Verified()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// Close stops the scrubber
+	db.Close()
+
+	if len(s.Verified()) < 2 || failures != 0 {
+		t.Fatalf("expected the manifest and journal to be verified, got %v and %d failures", s.Verified(), failures)
+	}
+	if db.StorageMetrics().Snapshot().VerifiedFiles < 2 {
+		t.Fatal("expected verifications to be counted")
+	}
+}
+
+func TestEncryptedDB_CloseLeak(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+
+	db, e := OpenAESEncryptedFile(d, testKey, nil)
+	if e != nil {
+		t.Fatalf("Could not create DB: %s", e.Error())
+	}
+	meta, e := db.stor.GetMeta()
+	if e != nil {
+		t.Fatalf("GetMeta: %s", e.Error())
+	}
+	// A reader of the storage's own, which the database doesn't know to close
+	r, e := db.stor.Open(meta)
+	if e != nil {
+		t.Fatalf("Open: %s", e.Error())
+	}
+	defer r.Close()
+
+	var leak *aesgcm.LeakError
+	if e := db.Close(); !errors.As(e, &leak) || len(leak.Handles) != 1 {
+		t.Fatalf("expected Close to report the leaked reader, got %v", e)
+	}
+}
+
+func TestEncryptedDB_Checkpoint(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+	cp := d + ".checkpoint"
+	defer os.RemoveAll(cp)
+
+	db, e := OpenAESEncryptedFile(d, testKey, &opt.Options{WriteBuffer: 32 << 10})
+	if e != nil {
+		t.Fatalf("Could not create DB: %s", e.Error())
+	}
+	defer db.Close()
+	// Not synced, the checkpoint commits the journal itself
+	for i := 0; i < 200; i++ {
+		if e := db.Put([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 1000), nil); e != nil {
+			t.Fatalf("Put: %s", e.Error())
+		}
+	}
+
+	if e := db.Checkpoint(cp); e != nil {
+		t.Fatalf("Checkpoint: %s", e.Error())
+	}
+	if e := db.Checkpoint(cp); e == nil {
+		t.Fatal("expected a checkpoint into an existing directory to fail")
+	}
+	if e := db.Put([]byte("after"), nil, nil); e != nil {
+		t.Fatalf("Put: %s", e.Error())
+	}
+
+	tables, _ := filepath.Glob(filepath.Join(cp, "*.ldb"))
+	if len(tables) == 0 {
+		t.Fatal("expected tables in the checkpoint")
+	}
+	for _, name := range tables {
+		a, e1 := os.Stat(name)
+		b, e2 := os.Stat(filepath.Join(d, filepath.Base(name)))
+		if e1 != nil || e2 != nil || !os.SameFile(a, b) {
+			t.Fatalf("expected %s to be hard-linked, got %v, %v", name, e1, e2)
+		}
+	}
+
+	cdb, e := OpenAESEncryptedFile(cp, testKey, nil)
+	if e != nil {
+		t.Fatalf("Could not open checkpoint: %s", e.Error())
+	}
+	defer cdb.Close()
+	for i := 0; i < 200; i++ {
+		if _, e := cdb.Get([]byte(fmt.Sprintf("key%04d", i)), nil); e != nil {
+			t.Fatalf("expected key%04d in the checkpoint, got %v", i, e)
+		}
+	}
+	if _, e := cdb.Get([]byte("after"), nil); e != leveldb.ErrNotFound {
+		t.Fatalf("expected writes after the checkpoint to be missing from it, got %v", e)
+	}
+}
+
+// copyDir copies the files of a database directory, as a crash would leave them
+func copyDir(t *testing.T, src, dst string) {
+	if err := os.Mkdir(dst, 0700); err != nil {
+		t.Fatal(err)
+	}
+	names, err := filepath.Glob(filepath.Join(src, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, filepath.Base(name)), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenAESEncryptedFile_CrashAfterReopen(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+	crashed := d + ".crashed"
+	defer os.RemoveAll(crashed)
+
+	db, e := OpenAESEncryptedFile(d, testKey, nil)
+	if e != nil {
+		t.Fatalf("Could not create DB: %s", e.Error())
+	}
+	db.Close()
+
+	// goleveldb writes a new manifest on every open and points CURRENT at it without syncing it
+	db, e = OpenAESEncryptedFile(d, testKey, nil)
+	if e != nil {
+		t.Fatalf("Could not reopen DB: %s", e.Error())
+	}
+	defer db.Close()
+	if e := db.Put([]byte("key"), []byte("value"), &opt.WriteOptions{Sync: true}); e != nil {
+		t.Fatalf("Put: %s", e.Error())
+	}
+	copyDir(t, d, crashed)
+
+	cdb, e := OpenAESEncryptedFile(crashed, testKey, nil)
+	if e != nil {
+		t.Fatalf("Could not open the DB after a crash: %s", e.Error())
+	}
+	defer cdb.Close()
+	if v, e := cdb.Get([]byte("key"), nil); e != nil || string(v) != "value" {
+		t.Fatalf("expected the synced key after a crash, got %q, %v", v, e)
+	}
+}
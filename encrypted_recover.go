@@ -0,0 +1,202 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * encrypted_recover.go: Encrypted equivalent of leveldb.RecoverFile
+ */
+
+package goleveldb_encrypted
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/tenta-browser/goleveldb-encrypted/aesgcm"
+)
+
+var (
+	// ErrTableUnrecoverable is the reason given for tables goleveldb dropped because none of their keys
+	// could be read
+	ErrTableUnrecoverable = errors.New("goleveldb-encrypted: table has no readable keys")
+
+	// ErrTableCorrupted is the reason given for tables goleveldb dropped because of corrupted keys or
+	// blocks, which only happens with opt.StrictRecovery
+	ErrTableCorrupted = errors.New("goleveldb-encrypted: table has corrupted keys or blocks")
+)
+
+// DroppedFile is a file left out of the database rebuilt by RecoverAESEncryptedFile
+type DroppedFile struct {
+	Fd storage.FileDesc
+	// Why the file was dropped: a *storage.ErrCorrupted from the encrypted storage for files that failed to
+	// decrypt, or one of ErrTableUnrecoverable and ErrTableCorrupted for tables goleveldb itself dropped
+	Err error
+}
+
+// RecoverReport lists what RecoverAESEncryptedFile dropped
+type RecoverReport struct {
+	Dropped []DroppedFile
+}
+
+// RecoverAESEncryptedFile is the encrypted equivalent of leveldb.RecoverFile: it ignores the manifest and
+// rebuilds one from the tables in the directory. Tables that fail to decrypt would make goleveldb abort the
+// whole recovery, so every table is authenticated first and those that fail are hidden from it. They are
+// reported, together with the tables goleveldb dropped itself, and are left on disk until goleveldb removes
+// them as obsolete on a later open. With aesgcm.Options.Quarantine set in sopt, tables failing to decrypt
+// are moved to the quarantine directory instead. The key is checked first: if no file of the database
+// authenticates under it, recovery fails with aesgcm.ErrWrongKey before hiding or writing anything.
+func RecoverAESEncryptedFile(path string, key []byte, opt *opt.Options) (db *EncryptedDB, report *RecoverReport, err error) {
+	return RecoverAESEncryptedFileWithOptions(path, key, opt, nil)
+}
+
+// RecoverAESEncryptedFileWithOptions is RecoverAESEncryptedFile with the optional parameters of the
+// encrypted storage in sopt, which may be nil. Recovery writes a new manifest, so the storage can't be
+// read-only.
+func RecoverAESEncryptedFileWithOptions(path string, key []byte, opt *opt.Options, sopt *aesgcm.Options) (db *EncryptedDB, report *RecoverReport, err error) {
+	so := aesgcm.Options{}
+	if sopt != nil {
+		so = *sopt
+	}
+	so.ReadOnly = false
+	stor, err := aesgcm.OpenEncryptedFileWithOptions(path, key, &so)
+	if err != nil {
+		return
+	}
+	rs := &recoverStorage{Storage: stor, hidden: make(map[storage.FileDesc]bool)}
+	defer func() {
+		if err != nil {
+			stor.Close()
+		}
+	}()
+
+	// With the wrong key every table would fail and be hidden, and the new manifest sealed under it
+	if err = stor.CheckKey(); err != nil {
+		return
+	}
+	if err = rs.authenticateTables(); err != nil {
+		return
+	}
+	before, err := rs.List(storage.TypeTable)
+	if err != nil {
+		return
+	}
+
+	// The tables goleveldb drops are left out of the new manifest and removed as obsolete when it opens the
+	// database. Compactions would remove recovered tables as well, so it recovers without any, and the
+	// database is opened again with opt once the dropped tables are known.
+	ldb, err := leveldb.Recover(rs, recoveryOptions(opt))
+	if err != nil {
+		return
+	}
+	if err = ldb.Close(); err != nil {
+		return
+	}
+	after, err := rs.List(storage.TypeTable)
+	if err != nil {
+		return
+	}
+	kept := make(map[storage.FileDesc]bool, len(after))
+	for _, fd := range after {
+		kept[fd] = true
+	}
+	reason := dropReason(opt)
+	for _, fd := range before {
+		if !kept[fd] {
+			rs.dropped = append(rs.dropped, DroppedFile{Fd: fd, Err: reason})
+		}
+	}
+
+	if ldb, err = leveldb.Open(rs, opt); err != nil {
+		return
+	}
+	report = &RecoverReport{Dropped: rs.dropped}
+	db = &EncryptedDB{
+		DB:   ldb,
+		stor: rs,
+	}
+	return
+}
+
+// recoveryOptions copies o, disabling compactions
+func recoveryOptions(o *opt.Options) *opt.Options {
+	ro := opt.Options{}
+	if o != nil {
+		ro = *o
+	}
+	ro.CompactionL0Trigger = math.MaxInt32
+	ro.WriteL0SlowdownTrigger = math.MaxInt32
+	ro.WriteL0PauseTrigger = math.MaxInt32
+	return &ro
+}
+
+// dropReason is why goleveldb dropped a table: with strict recovery, any corruption drops it, otherwise
+// only having no readable key does
+func dropReason(o *opt.Options) error {
+	if o.GetStrict(opt.StrictRecovery) {
+		return ErrTableCorrupted
+	}
+	return ErrTableUnrecoverable
+}
+
+// recoverStorage hides the tables that failed to decrypt from goleveldb. The set is only written before
+// goleveldb starts.
+type recoverStorage struct {
+	aesgcm.Storage
+
+	hidden  map[storage.FileDesc]bool
+	dropped []DroppedFile
+}
+
+func (rs *recoverStorage) authenticateTables() error {
+	fds, err := rs.Storage.List(storage.TypeTable)
+	if err != nil {
+		return err
+	}
+	for _, fd := range fds {
+		r, err := rs.Storage.Open(fd)
+		if err == nil {
+			r.Close()
+			continue
+		}
+		if !lerrors.IsCorrupted(err) || errors.Is(aesgcm.Cause(err), aesgcm.ErrWrongKey) {
+			return err
+		}
+		rs.Storage.Log(fmt.Sprintf("table@recovery failed to decrypt @%d %q", fd.Num, err))
+		rs.hidden[fd] = true
+		rs.dropped = append(rs.dropped, DroppedFile{Fd: fd, Err: err})
+	}
+	return nil
+}
+
+func (rs *recoverStorage) List(ft storage.FileType) ([]storage.FileDesc, error) {
+	fds, err := rs.Storage.List(ft)
+	if err != nil {
+		return nil, err
+	}
+	visible := fds[:0]
+	for _, fd := range fds {
+		if !rs.hidden[fd] {
+			visible = append(visible, fd)
+		}
+	}
+	return visible, nil
+}
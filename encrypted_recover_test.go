@@ -0,0 +1,138 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * encrypted_recover_test.go: Recovery of an encrypted database with a lost manifest and damaged tables
+ */
+
+package goleveldb_encrypted
+
+import (
+	"errors"
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/tenta-browser/goleveldb-encrypted/aesgcm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestRecoverAESEncryptedFile(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+
+	o := &opt.Options{WriteBuffer: 32 << 10, DisableCompactionBackoff: true, CompactionL0Trigger: 1000}
+	db, e := OpenAESEncryptedFile(d, testKey, o)
+	if e != nil {
+		t.Fatalf("Could not create DB: %s", e.Error())
+	}
+	value := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		if e := db.Put([]byte(fmt.Sprintf("key%04d", i)), value, nil); e != nil {
+			t.Fatalf("Put: %s", e.Error())
+		}
+	}
+	db.Close()
+
+	tables, e := filepath.Glob(filepath.Join(d, "*.ldb"))
+	if e != nil || len(tables) < 2 {
+		t.Fatalf("expected several tables, got %v, %v", tables, e)
+	}
+	sort.Strings(tables)
+
+	// Damage the first table and lose the manifest
+	b, e := ioutil.ReadFile(tables[0])
+	if e != nil {
+		t.Fatal(e)
+	}
+	b[len(b)/2] ^= 1
+	if e := ioutil.WriteFile(tables[0], b, 0644); e != nil {
+		t.Fatal(e)
+	}
+	manifests, _ := filepath.Glob(filepath.Join(d, "MANIFEST-*"))
+	for _, m := range manifests {
+		os.Remove(m)
+	}
+
+	if _, e := OpenAESEncryptedFile(d, testKey, o); e == nil {
+		t.Fatal("expected opening without a manifest to fail")
+	}
+
+	db, report, e := RecoverAESEncryptedFile(d, testKey, o)
+	if e != nil {
+		t.Fatalf("Could not recover DB: %s", e.Error())
+	}
+	defer db.Close()
+
+	if len(report.Dropped) != 1 {
+		t.Fatalf("expected a single dropped table, got %v", report.Dropped)
+	}
+	dropped := report.Dropped[0]
+	if filepath.Join(d, fmt.Sprintf("%06d.ldb", dropped.Fd.Num)) != tables[0] || dropped.Fd.Type != storage.TypeTable {
+		t.Fatalf("expected %s to be dropped, got %s", tables[0], dropped.Fd)
+	}
+	if !errors.Is(aesgcm.Cause(dropped.Err), aesgcm.ErrAuthFailed) {
+		t.Fatalf("expected an authentication failure, got %v", dropped.Err)
+	}
+
+	// Keys in the other tables survive
+	found := 0
+	for i := 0; i < 200; i++ {
+		if h, _ := db.Has([]byte(fmt.Sprintf("key%04d", i)), nil); h {
+			found++
+		}
+	}
+	if found == 0 || found == 200 {
+		t.Fatalf("expected the keys of the damaged table only to be lost, found %d of 200", found)
+	}
+}
+
+func TestRecoverAESEncryptedFile_WrongKey(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+
+	o := &opt.Options{WriteBuffer: 32 << 10}
+	db, e := OpenAESEncryptedFile(d, testKey, o)
+	if e != nil {
+		t.Fatalf("Could not create DB: %s", e.Error())
+	}
+	for i := 0; i < 100; i++ {
+		if e := db.Put([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 1000), nil); e != nil {
+			t.Fatalf("Put: %s", e.Error())
+		}
+	}
+	db.Close()
+
+	wrongKey := append([]byte(nil), testKey...)
+	wrongKey[0] ^= 1
+	if _, _, e := RecoverAESEncryptedFileWithOptions(d, wrongKey, o, &aesgcm.Options{Quarantine: true}); !errors.Is(e, aesgcm.ErrWrongKey) {
+		t.Fatalf("expected recovery with the wrong key to fail, got %v", e)
+	}
+
+	db, e = OpenAESEncryptedFile(d, testKey, o)
+	if e != nil {
+		t.Fatalf("Could not reopen DB with the right key: %s", e.Error())
+	}
+	defer db.Close()
+	if h, _ := db.Has([]byte("key0099"), nil); !h {
+		t.Fatal("expected the keys to survive a recovery attempt with the wrong key")
+	}
+}
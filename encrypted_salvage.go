@@ -0,0 +1,344 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * encrypted_salvage.go: Best effort export of the records surviving in a damaged database
+ */
+
+package goleveldb_encrypted
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/journal"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/table"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tenta-browser/goleveldb-encrypted/aesgcm"
+)
+
+const (
+	// Internal keys end with the sequence number and key type packed in 8 bytes
+	internalKeyTrailerLen = 8
+	// Journal records start with the batch's sequence number and record count
+	batchHeaderLen = 8 + 4
+
+	keyTypeDel = 0
+	keyTypeVal = 1
+)
+
+// SalvagedFile is what SalvageAESEncryptedFile got out of a single table or journal
+type SalvagedFile struct {
+	Fd storage.FileDesc
+	// Puts and deletes read from the file
+	Records int
+	// Table blocks, or journal bytes, that had to be skipped
+	CorruptedBlocks int
+	DroppedBytes    int64
+	// Plaintext bytes of the file that failed authentication, and ciphertext bytes that couldn't even be
+	// split into chunks, when the file had to be salvaged chunk by chunk
+	DamagedBytes int64
+	LostBytes    int64
+	// Why the file, or part of it, couldn't be read. Nil when it was read entirely.
+	Err error
+}
+
+// SalvageReport is what SalvageAESEncryptedFile recovered and lost
+type SalvageReport struct {
+	Files []SalvagedFile
+	// Keys written to the new database, and keys left out because their newest record deletes them
+	Keys    int
+	Deleted int
+	// Highest sequence number seen
+	MaxSeq uint64
+}
+
+// Lost returns the files that couldn't be read entirely
+func (r *SalvageReport) Lost() []SalvagedFile {
+	var lost []SalvagedFile
+	for _, f := range r.Files {
+		if f.Err != nil || f.CorruptedBlocks > 0 || f.DroppedBytes > 0 || f.DamagedBytes > 0 || f.LostBytes > 0 {
+			lost = append(lost, f)
+		}
+	}
+	return lost
+}
+
+type salvagedRecord struct {
+	seq   uint64
+	kt    byte
+	value []byte
+}
+
+// salvager keeps the newest record of every key
+type salvager struct {
+	records map[string]salvagedRecord
+	report  SalvageReport
+}
+
+func (s *salvager) add(key []byte, seq uint64, kt byte, value []byte) {
+	if seq > s.report.MaxSeq {
+		s.report.MaxSeq = seq
+	}
+	r, ok := s.records[string(key)]
+	if ok && r.seq >= seq {
+		return
+	}
+	wipe(r.value)
+	s.records[string(key)] = salvagedRecord{seq: seq, kt: kt, value: append([]byte(nil), value...)}
+}
+
+// wipe clears the values held, the keys are strings and stay
+func (s *salvager) wipe() {
+	for _, r := range s.records {
+		wipe(r.value)
+	}
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// SalvageAESEncryptedFile copies every record it can still read from the encrypted database at src into a
+// new encrypted database at dst, under the same key. It doesn't trust the manifest: every table and journal
+// is parsed directly, skipping corrupted blocks and journal chunks, and for each key the record with the
+// highest sequence number wins. Files that fail to decrypt are salvaged chunk by chunk, see
+// aesgcm.Storage.Salvage, so only the blocks in their damaged chunks are lost. Keys whose newest record is
+// a deletion are left out. The report lists what every file yielded and why any of it was lost.
+//
+// All surviving records are held in memory until written out, so the database has to fit in memory. The
+// plaintext copies made along the way, salvaged file contents, journal records, values and write batches,
+// are wiped once used. Keys are held as strings and can't be, nor can the buffers inside goleveldb's table
+// reader and the new database. src is only read, and dst must not exist yet. If no file of src
+// authenticates under key, it fails with aesgcm.ErrWrongKey before dst is created.
+func SalvageAESEncryptedFile(src, dst string, key []byte) (*SalvageReport, error) {
+	stor, err := aesgcm.OpenEncryptedFile(src, key, true)
+	if err != nil {
+		return nil, err
+	}
+	defer stor.Close()
+	// Nothing would decrypt, leaving an empty dst reported as a success
+	if err := stor.CheckKey(); err != nil {
+		return nil, err
+	}
+
+	s := &salvager{records: make(map[string]salvagedRecord)}
+	defer s.wipe()
+	for _, ft := range []storage.FileType{storage.TypeTable, storage.TypeJournal} {
+		fds, err := stor.List(ft)
+		if err != nil {
+			return nil, err
+		}
+		for _, fd := range fds {
+			f := SalvagedFile{Fd: fd}
+			if err := s.salvageFile(stor, &f); err != nil {
+				f.Err = err
+			}
+			s.report.Files = append(s.report.Files, f)
+		}
+	}
+
+	db, err := OpenAESEncryptedFile(dst, key, &opt.Options{ErrorIfExist: true})
+	if err != nil {
+		return nil, err
+	}
+	batch := new(leveldb.Batch)
+	defer func() { wipe(batch.Dump()) }()
+	for k, r := range s.records {
+		if r.kt != keyTypeVal {
+			s.report.Deleted++
+			continue
+		}
+		batch.Put([]byte(k), r.value)
+		s.report.Keys++
+		if batch.Len() >= 1000 {
+			if err := db.Write(batch, nil); err != nil {
+				db.Close()
+				return nil, err
+			}
+			wipe(batch.Dump())
+			batch.Reset()
+		}
+	}
+	if err := db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	return &s.report, nil
+}
+
+// salvageFile reads a table or journal whole when it decrypts, or chunk by chunk when it doesn't
+func (s *salvager) salvageFile(stor aesgcm.Storage, f *SalvagedFile) error {
+	var (
+		r    io.ReaderAt
+		size int64
+	)
+	if sr, err := stor.Open(f.Fd); err == nil {
+		defer sr.Close()
+		if size, err = sr.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+		r = sr
+	} else if lerrors.IsCorrupted(err) {
+		res, serr := stor.Salvage(f.Fd)
+		if serr != nil {
+			return serr
+		}
+		f.Err = err
+		for _, d := range res.Damaged {
+			f.DamagedBytes += d.Len
+		}
+		f.LostBytes = res.Lost
+		defer wipe(res.Data)
+		r, size = bytes.NewReader(res.Data), int64(len(res.Data))
+	} else {
+		return err
+	}
+
+	if f.Fd.Type == storage.TypeTable {
+		s.salvageTable(r, size, f)
+	} else {
+		s.salvageJournal(io.NewSectionReader(r, 0, size), f)
+	}
+	return nil
+}
+
+func (s *salvager) salvageTable(r io.ReaderAt, size int64, f *SalvagedFile) {
+	// Check block checksums, but skip the blocks that fail rather than stopping there
+	o := &opt.Options{Strict: opt.StrictBlockChecksum}
+	tr, err := table.NewReader(r, size, f.Fd, nil, util.NewBufferPool(opt.DefaultBlockSize), o)
+	if err != nil {
+		f.Err = err
+		return
+	}
+	defer tr.Release()
+	iter := tr.NewIterator(nil, nil)
+	defer iter.Release()
+	if itererr, ok := iter.(iterator.ErrorCallbackSetter); ok {
+		itererr.SetErrorCallback(func(err error) {
+			f.CorruptedBlocks++
+			if f.Err == nil {
+				f.Err = err
+			}
+		})
+	}
+	for iter.Next() {
+		ikey := iter.Key()
+		if len(ikey) < internalKeyTrailerLen {
+			f.CorruptedBlocks++
+			continue
+		}
+		trailer := binary.LittleEndian.Uint64(ikey[len(ikey)-internalKeyTrailerLen:])
+		kt := byte(trailer & 0xff)
+		if kt > keyTypeVal {
+			f.CorruptedBlocks++
+			continue
+		}
+		s.add(ikey[:len(ikey)-internalKeyTrailerLen], trailer>>8, kt, iter.Value())
+		f.Records++
+	}
+	if err := iter.Error(); err != nil && f.Err == nil {
+		f.Err = err
+	}
+}
+
+// journalDropper counts what the journal reader skips
+type journalDropper struct {
+	f *SalvagedFile
+}
+
+func (d journalDropper) Drop(err error) {
+	if cerr, ok := err.(*journal.ErrCorrupted); ok {
+		d.f.DroppedBytes += int64(cerr.Size)
+	}
+	if d.f.Err == nil {
+		d.f.Err = err
+	}
+}
+
+func (s *salvager) salvageJournal(r io.Reader, f *SalvagedFile) {
+	jr := journal.NewReader(r, journalDropper{f}, false, true)
+	batch := new(leveldb.Batch)
+	for {
+		rec, err := jr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			f.Err = err
+			return
+		}
+		data, err := ioutil.ReadAll(rec)
+		if err != nil {
+			// The reader already reported the chunk to the dropper, try the next record
+			wipe(data)
+			continue
+		}
+		s.salvageBatch(data, batch, f)
+		wipe(data)
+	}
+}
+
+// salvageBatch adds the records of a journal record, loaded into batch without copying
+func (s *salvager) salvageBatch(data []byte, batch *leveldb.Batch, f *SalvagedFile) {
+	if len(data) < batchHeaderLen {
+		f.DroppedBytes += int64(len(data))
+		return
+	}
+	seq := binary.LittleEndian.Uint64(data)
+	if err := batch.Load(data[batchHeaderLen:]); err != nil {
+		f.DroppedBytes += int64(len(data))
+		if f.Err == nil {
+			f.Err = fmt.Errorf("goleveldb-encrypted: %s: batch at sequence %d: %v", f.Fd, seq, err)
+		}
+		return
+	}
+	batch.Replay(&salvageReplay{s: s, f: f, seq: seq})
+}
+
+// salvageReplay numbers the records of a batch from its sequence number
+type salvageReplay struct {
+	s   *salvager
+	f   *SalvagedFile
+	seq uint64
+}
+
+func (r *salvageReplay) Put(key, value []byte) {
+	r.s.add(key, r.seq, keyTypeVal, value)
+	r.seq++
+	r.f.Records++
+}
+
+func (r *salvageReplay) Delete(key []byte) {
+	r.s.add(key, r.seq, keyTypeDel, nil)
+	r.seq++
+	r.f.Records++
+}
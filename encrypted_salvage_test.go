@@ -0,0 +1,195 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * encrypted_salvage_test.go: Salvage of the records surviving in a damaged database
+ */
+
+package goleveldb_encrypted
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/tenta-browser/goleveldb-encrypted/aesgcm"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestSalvageAESEncryptedFile(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+
+	o := &opt.Options{WriteBuffer: 32 << 10, DisableCompactionBackoff: true, CompactionL0Trigger: 1000}
+	db, e := OpenAESEncryptedFile(d, testKey, o)
+	if e != nil {
+		t.Fatalf("Could not create DB: %s", e.Error())
+	}
+	value := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		if e := db.Put([]byte(fmt.Sprintf("key%04d", i)), value, nil); e != nil {
+			t.Fatalf("Put: %s", e.Error())
+		}
+	}
+	// Newer records win: overwritten in the journal, and deleted
+	if e := db.Put([]byte("key0199"), []byte("newest"), nil); e != nil {
+		t.Fatalf("Put: %s", e.Error())
+	}
+	if e := db.Delete([]byte("key0198"), nil); e != nil {
+		t.Fatalf("Delete: %s", e.Error())
+	}
+	db.Close()
+
+	tables, e := filepath.Glob(filepath.Join(d, "*.ldb"))
+	if e != nil || len(tables) < 2 {
+		t.Fatalf("expected several tables, got %v, %v", tables, e)
+	}
+	sort.Strings(tables)
+	b, e := ioutil.ReadFile(tables[0])
+	if e != nil {
+		t.Fatal(e)
+	}
+	b[len(b)/2] ^= 1
+	if e := ioutil.WriteFile(tables[0], b, 0644); e != nil {
+		t.Fatal(e)
+	}
+	manifests, _ := filepath.Glob(filepath.Join(d, "MANIFEST-*"))
+	for _, m := range manifests {
+		os.Remove(m)
+	}
+
+	out := filepath.Join(d, "salvaged")
+	report, e := SalvageAESEncryptedFile(d, out, testKey)
+	if e != nil {
+		t.Fatalf("Salvage: %s", e.Error())
+	}
+	lost := report.Lost()
+	if len(lost) != 1 || lost[0].Fd.Type != storage.TypeTable || filepath.Join(d, fmt.Sprintf("%06d.ldb", lost[0].Fd.Num)) != tables[0] {
+		t.Fatalf("expected %s to be lost, got %+v", tables[0], lost)
+	}
+	if report.Deleted != 1 || report.Keys == 0 || report.Keys >= 199 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	db, e = OpenAESEncryptedFile(out, testKey, nil)
+	if e != nil {
+		t.Fatalf("Could not open salvaged DB: %s", e.Error())
+	}
+	defer db.Close()
+	if v, e := db.Get([]byte("key0199"), nil); e != nil || !bytes.Equal(v, []byte("newest")) {
+		t.Fatalf("expected the newest value, got %q, %v", v, e)
+	}
+	if h, _ := db.Has([]byte("key0198"), nil); h {
+		t.Fatal("expected the deleted key to stay deleted")
+	}
+	found := 0
+	for i := 0; i < 198; i++ {
+		if v, e := db.Get([]byte(fmt.Sprintf("key%04d", i)), nil); e == nil && bytes.Equal(v, value) {
+			found++
+		}
+	}
+	if found != report.Keys-1 {
+		t.Fatalf("expected %d keys, found %d", report.Keys-1, found)
+	}
+}
+
+// Plaintext held by each chunk of the encrypted storage
+const storageChunkSize = 64 << 10
+
+func TestSalvageAESEncryptedFile_DamagedChunk(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+
+	db, e := OpenAESEncryptedFile(d, testKey, nil)
+	if e != nil {
+		t.Fatalf("Could not create DB: %s", e.Error())
+	}
+	for i := 0; i < 500; i++ {
+		value := make([]byte, 1000)
+		rand.Read(value)
+		if e := db.Put([]byte(fmt.Sprintf("key%04d", i)), value, nil); e != nil {
+			t.Fatalf("Put: %s", e.Error())
+		}
+	}
+	db.Close()
+	// Reopening flushes the journal into a single table of several chunks
+	if db, e = OpenAESEncryptedFile(d, testKey, nil); e != nil {
+		t.Fatalf("Could not reopen DB: %s", e.Error())
+	}
+	db.Close()
+
+	tables, e := filepath.Glob(filepath.Join(d, "*.ldb"))
+	if e != nil || len(tables) != 1 {
+		t.Fatalf("expected a single table, got %v, %v", tables, e)
+	}
+	b, e := ioutil.ReadFile(tables[0])
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(b) < 4*storageChunkSize {
+		t.Fatalf("expected a table of several chunks, got %d bytes", len(b))
+	}
+	b[2*storageChunkSize] ^= 1
+	if e := ioutil.WriteFile(tables[0], b, 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	report, e := SalvageAESEncryptedFile(d, filepath.Join(d, "salvaged"), testKey)
+	if e != nil {
+		t.Fatalf("Salvage: %s", e.Error())
+	}
+	lost := report.Lost()
+	if len(lost) != 1 || lost[0].DamagedBytes != storageChunkSize || lost[0].CorruptedBlocks == 0 {
+		t.Fatalf("expected a single damaged chunk, got %+v", lost)
+	}
+	// Only the blocks in the damaged chunk are lost
+	if report.Keys < 300 || report.Keys >= 500 {
+		t.Fatalf("expected most keys to be salvaged, got %d", report.Keys)
+	}
+}
+
+func TestSalvageAESEncryptedFile_WrongKey(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+	dst := d + ".salvaged"
+	defer os.RemoveAll(dst)
+
+	db, e := OpenAESEncryptedFile(d, testKey, nil)
+	if e != nil {
+		t.Fatalf("Could not create DB: %s", e.Error())
+	}
+	if e := db.Put([]byte("key"), []byte("value"), &opt.WriteOptions{Sync: true}); e != nil {
+		t.Fatalf("Put: %s", e.Error())
+	}
+	db.Close()
+
+	wrongKey := append([]byte(nil), testKey...)
+	wrongKey[0] ^= 1
+	if _, e := SalvageAESEncryptedFile(d, dst, wrongKey); !errors.Is(e, aesgcm.ErrWrongKey) {
+		t.Fatalf("expected salvaging with the wrong key to fail, got %v", e)
+	}
+	if _, e := os.Stat(dst); !os.IsNotExist(e) {
+		t.Fatalf("expected no destination to be created, got %v", e)
+	}
+}
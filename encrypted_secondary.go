@@ -0,0 +1,224 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * encrypted_secondary.go: Read-only instance following a live writer
+ */
+
+package goleveldb_encrypted
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tenta-browser/goleveldb-encrypted/aesgcm"
+)
+
+// Opening a secondary is retried this many times when the writer removes a file it was reading
+const secondaryOpenAttempts = 5
+
+// ErrNotSecondary is returned by Refresh on a database not opened by OpenAESEncryptedFileSecondary
+var ErrNotSecondary = errors.New("goleveldb-encrypted: not a secondary database")
+
+// OpenAESEncryptedFileSecondary opens the database at path read-only while another process has it open
+// and is writing to it. It sees the database as of its last Sync, and Refresh catches it up. Reads of
+// tables the writer has since compacted away fail with an error satisfying os.IsNotExist until the next
+// Refresh.
+func OpenAESEncryptedFileSecondary(path string, key []byte, o *opt.Options, sopt *aesgcm.Options) (db *EncryptedDB, err error) {
+	so := aesgcm.Options{}
+	if sopt != nil {
+		so = *sopt
+	}
+	so.Secondary = true
+	stor, err := aesgcm.OpenEncryptedFileWithOptions(path, key, &so)
+	if err != nil {
+		return
+	}
+
+	ro := opt.Options{}
+	if o != nil {
+		ro = *o
+	}
+	ro.ReadOnly = true
+	ldb, err := openSecondary(stor, &ro)
+	if err != nil {
+		stor.Close()
+		return
+	}
+	return &EncryptedDB{
+		DB:        ldb,
+		stor:      stor,
+		secondary: &ro,
+		ref:       &dbRef{db: ldb, refs: 1},
+	}, nil
+}
+
+// Refresh reopens a secondary database on the current manifest and journals of the writer. On error the
+// database is left as it was.
+//
+// Refresh may run concurrently with reads. It waits for the calls in progress, and iterators keep reading
+// the database they were made on, which is closed once the last of them is released. Snapshots and
+// transactions aren't tracked, so those taken before must be released first.
+func (e *EncryptedDB) Refresh() error {
+	if e.secondary == nil {
+		return ErrNotSecondary
+	}
+	ldb, err := openSecondary(e.stor, e.secondary)
+	if err != nil {
+		return err
+	}
+	e.swap.Lock()
+	old := e.ref
+	e.DB, e.ref = ldb, &dbRef{db: ldb, refs: 1}
+	e.swap.Unlock()
+	return old.release()
+}
+
+// openSecondary opens goleveldb read-only, starting over while the writer removes the manifest or a journal
+// between being listed and opened, or replaces a journal that is being replayed, which ends the replay with
+// io.EOF
+func openSecondary(stor aesgcm.Storage, o *opt.Options) (ldb *leveldb.DB, err error) {
+	for i := 0; i < secondaryOpenAttempts; i++ {
+		ldb, err = leveldb.Open(stor, o)
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, io.EOF) {
+			break
+		}
+	}
+	return
+}
+
+// dbRef counts the references to a database opened by a secondary: its own, until Refresh replaces it, and
+// one for each open iterator
+type dbRef struct {
+	db   *leveldb.DB
+	refs int32
+}
+
+// release drops a reference, closing the database with the last
+func (r *dbRef) release() error {
+	if atomic.AddInt32(&r.refs, -1) == 0 {
+		return r.db.Close()
+	}
+	return nil
+}
+
+// refIterator holds a reference to its database until released
+type refIterator struct {
+	iterator.Iterator
+	ref  *dbRef
+	once sync.Once
+}
+
+func (it *refIterator) Release() {
+	it.Iterator.Release()
+	it.once.Do(func() { it.ref.release() })
+}
+
+// The methods of leveldb.DB, each holding off Refresh while it runs.
+
+func (e *EncryptedDB) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.Get(key, ro)
+}
+
+func (e *EncryptedDB) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.Has(key, ro)
+}
+
+// NewIterator is leveldb.DB.NewIterator. On a secondary database the iterator stays on the database it
+// was made on across Refresh, until released.
+func (e *EncryptedDB) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	it := e.DB.NewIterator(slice, ro)
+	if e.ref == nil {
+		return it
+	}
+	atomic.AddInt32(&e.ref.refs, 1)
+	return &refIterator{Iterator: it, ref: e.ref}
+}
+
+func (e *EncryptedDB) GetSnapshot() (*leveldb.Snapshot, error) {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.GetSnapshot()
+}
+
+func (e *EncryptedDB) GetProperty(name string) (string, error) {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.GetProperty(name)
+}
+
+func (e *EncryptedDB) Stats(s *leveldb.DBStats) error {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.Stats(s)
+}
+
+func (e *EncryptedDB) SizeOf(ranges []util.Range) (leveldb.Sizes, error) {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.SizeOf(ranges)
+}
+
+func (e *EncryptedDB) OpenTransaction() (*leveldb.Transaction, error) {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.OpenTransaction()
+}
+
+func (e *EncryptedDB) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.Write(batch, wo)
+}
+
+func (e *EncryptedDB) Put(key, value []byte, wo *opt.WriteOptions) error {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.Put(key, value, wo)
+}
+
+func (e *EncryptedDB) Delete(key []byte, wo *opt.WriteOptions) error {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.Delete(key, wo)
+}
+
+func (e *EncryptedDB) CompactRange(r util.Range) error {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.CompactRange(r)
+}
+
+func (e *EncryptedDB) SetReadOnly() error {
+	e.swap.RLock()
+	defer e.swap.RUnlock()
+	return e.DB.SetReadOnly()
+}
@@ -0,0 +1,184 @@
+/**
+ * GoLevelDB Encrypted Storage
+ *
+ *    Copyright 2019 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * encrypted_secondary_test.go: Read-only instance following a live writer
+ */
+
+package goleveldb_encrypted
+
+import (
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tenta-browser/goleveldb-encrypted/aesgcm"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestOpenAESEncryptedFileSecondary(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+
+	db, e := OpenAESEncryptedFile(d, testKey, nil)
+	if e != nil {
+		t.Fatalf("Could not create DB: %s", e.Error())
+	}
+	defer db.Close()
+	sync := &opt.WriteOptions{Sync: true}
+	if e := db.Put([]byte("a"), []byte("1"), sync); e != nil {
+		t.Fatalf("Put: %s", e.Error())
+	}
+
+	sdb, e := OpenAESEncryptedFileSecondary(d, testKey, nil, nil)
+	if e != nil {
+		t.Fatalf("Could not open secondary: %s", e.Error())
+	}
+	defer sdb.Close()
+	if v, e := sdb.Get([]byte("a"), nil); e != nil || string(v) != "1" {
+		t.Fatalf("expected the secondary to read what was synced, got %q, %v", v, e)
+	}
+	if e := sdb.Put([]byte("x"), nil, nil); e == nil {
+		t.Fatal("expected the secondary to be read-only")
+	}
+
+	// Not seen until refreshed, including across compactions removing the files it had open
+	for i := 0; i < 100; i++ {
+		if e := db.Put([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 1000), sync); e != nil {
+			t.Fatalf("Put: %s", e.Error())
+		}
+	}
+	if _, e := sdb.Get([]byte("key0000"), nil); e != leveldb.ErrNotFound {
+		t.Fatalf("expected the secondary not to see new keys before a refresh, got %v", e)
+	}
+	if e := db.CompactRange(util.Range{}); e != nil {
+		t.Fatalf("CompactRange: %s", e.Error())
+	}
+	if e := sdb.Refresh(); e != nil {
+		t.Fatalf("Refresh: %s", e.Error())
+	}
+	for _, k := range []string{"a", "key0000", "key0099"} {
+		if _, e := sdb.Get([]byte(k), nil); e != nil {
+			t.Fatalf("expected %s after a refresh, got %v", k, e)
+		}
+	}
+
+	if e := db.Refresh(); e != ErrNotSecondary {
+		t.Fatalf("expected refreshing the writer to fail, got %v", e)
+	}
+}
+
+func TestOpenAESEncryptedFileSecondary_Rotated(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+
+	// Holding back the flush of the full memtable keeps the rotated journal around, so the secondary has
+	// to replay both
+	flush := make(chan struct{})
+	var flushed sync.Once
+	defer flushed.Do(func() { close(flush) })
+	hooks := &aesgcm.Hooks{Start: func(ev *aesgcm.TraceEvent) {
+		if ev.Op == aesgcm.OpCreate && ev.Fd.Type == storage.TypeTable {
+			<-flush
+		}
+	}}
+	db, e := OpenAESEncryptedFileWithOptions(d, testKey, &opt.Options{WriteBuffer: 16 << 10}, &aesgcm.Options{Hooks: hooks})
+	if e != nil {
+		t.Fatalf("Could not create DB: %s", e.Error())
+	}
+	defer db.Close()
+	wo := &opt.WriteOptions{Sync: true}
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if e := db.Put([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 1000), wo); e != nil {
+				t.Fatalf("Put: %s", e.Error())
+			}
+		}
+	}
+	put(0, 5)
+
+	sdb, e := OpenAESEncryptedFileSecondary(d, testKey, nil, nil)
+	if e != nil {
+		t.Fatalf("Could not open secondary: %s", e.Error())
+	}
+	defer sdb.Close()
+
+	// Readers run throughout, across every Refresh
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, e := sdb.Get([]byte("key0000"), nil); e != nil {
+					errs <- e
+					return
+				}
+				iter := sdb.NewIterator(nil, nil)
+				n := 0
+				for iter.Next() {
+					n++
+				}
+				iter.Release()
+				if e := iter.Error(); e != nil || n < 5 {
+					errs <- fmt.Errorf("iterated %d keys: %v", n, e)
+					return
+				}
+			}
+		}()
+	}
+
+	put(5, 25)
+	if fds, e := db.stor.List(storage.TypeJournal); e != nil || len(fds) < 2 {
+		t.Fatalf("expected the journal to be rotated, got %v (%v)", fds, e)
+	}
+	if e := sdb.Refresh(); e != nil {
+		t.Fatalf("Refresh: %s", e.Error())
+	}
+	if _, e := sdb.Get([]byte("key0024"), nil); e != nil {
+		t.Fatalf("expected the rotated journals to be replayed, got %v", e)
+	}
+
+	flushed.Do(func() { close(flush) })
+	for i := 25; i < 100; i += 25 {
+		put(i, i+25)
+		if e := sdb.Refresh(); e != nil {
+			t.Fatalf("Refresh: %s", e.Error())
+		}
+	}
+	close(stop)
+	readers.Wait()
+	select {
+	case e := <-errs:
+		t.Fatalf("reader failed: %v", e)
+	default:
+	}
+	if _, e := sdb.Get([]byte("key0099"), nil); e != nil {
+		t.Fatalf("expected key0099 after the last refresh, got %v", e)
+	}
+}